@@ -3,8 +3,11 @@ package main
 import (
 	_ "embed"
 	"fmt"
+	"log/slog"
+	"os"
 
 	"github.com/trunov/go-shortener/internal/app/config"
+	"github.com/trunov/go-shortener/internal/app/logger"
 )
 
 var (
@@ -20,12 +23,19 @@ func main() {
 		return
 	}
 
+	log, err := logger.New(os.Stdout, cfg.LogLevel)
+	if err != nil {
+		fmt.Printf("Error creating logger: %v\n", err)
+		return
+	}
+	slog.SetDefault(log)
+
 	fmt.Printf("Build version: %s\n", buildVersion)
 	fmt.Printf("Build date: %s\n", buildDate)
 	fmt.Printf("Build commit: %s\n", buildCommit)
 
 	if err := StartServer(cfg); err != nil {
-		fmt.Printf("Failed to start server: %v\n", err)
+		slog.Error("failed to start server", "error", err)
 		return
 	}
 }
@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -12,19 +15,173 @@ import (
 
 	"github.com/jackc/pgx/v4/pgxpool"
 	"golang.org/x/crypto/acme/autocert"
+	"google.golang.org/grpc"
 
+	"github.com/trunov/go-shortener/internal/app/analytics"
 	"github.com/trunov/go-shortener/internal/app/config"
+	"github.com/trunov/go-shortener/internal/app/encryption"
 	"github.com/trunov/go-shortener/internal/app/file"
+	"github.com/trunov/go-shortener/internal/app/grpchandler"
 	"github.com/trunov/go-shortener/internal/app/handler"
+	"github.com/trunov/go-shortener/internal/app/metrics"
+	"github.com/trunov/go-shortener/internal/app/middleware"
+	pb "github.com/trunov/go-shortener/internal/app/proto"
+	"github.com/trunov/go-shortener/internal/app/screening"
 	"github.com/trunov/go-shortener/internal/app/storage/memory"
 	"github.com/trunov/go-shortener/internal/app/storage/postgres"
 	"github.com/trunov/go-shortener/internal/app/util"
 	"github.com/trunov/go-shortener/migrate"
 )
 
+const (
+	// expiredSweepInterval is how often expired links are removed from the storage.
+	expiredSweepInterval = time.Minute
+
+	// clickBufferSize, clickBatchSize and clickFlushInterval tune how redirects are written to the storage.
+	clickBufferSize    = 10000
+	clickBatchSize     = 500
+	clickFlushInterval = time.Second
+)
+
+// newEncryptor builds the cookie encryptor from the keys in cfg.
+// Without a configured key a random one is generated, so cookies do not survive a restart.
+func newEncryptor(cfg config.Config) (*encryption.Encryptor, error) {
+	if cfg.CookieKey != "" && cfg.CookieKeyFile != "" {
+		return nil, errors.New("cookie_key and cookie_key_file cannot be set together")
+	}
+
+	var keys [][]byte
+
+	switch {
+	case cfg.CookieKeyFile != "":
+		fileKeys, err := encryption.ReadKeyFile(cfg.CookieKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cookie key file: %w", err)
+		}
+		keys = fileKeys
+	case cfg.CookieKey != "":
+		key, err := encryption.ParseKey(cfg.CookieKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cookie key: %w", err)
+		}
+		keys = [][]byte{key}
+	default:
+		slog.Warn("no cookie key configured, generating a random one; cookies will not survive a restart")
+		key, err := encryption.GenerateKey()
+		if err != nil {
+			return nil, err
+		}
+		keys = [][]byte{key}
+	}
+
+	for _, v := range cfg.PreviousCookieKeys {
+		key, err := encryption.ParseKey(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid previous cookie key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+
+	return encryption.NewEncryptor(keys[0], keys[1:]...), nil
+}
+
+// newCodec builds the codec of the user ID tokens in the format set in cfg.
+func newCodec(cfg config.Config) (encryption.Codec, error) {
+	switch cfg.TokenFormat {
+	case "encrypted":
+		return newEncryptor(cfg)
+	case "jwt":
+		return newJWT(cfg)
+	default:
+		return nil, fmt.Errorf("invalid token format %q, must be encrypted or jwt", cfg.TokenFormat)
+	}
+}
+
+// newJWT builds the JWT codec from the algorithm and key file in cfg.
+// Without a key file a random key is generated, so tokens do not survive a restart.
+func newJWT(cfg config.Config) (*encryption.JWT, error) {
+	if cfg.JWTKeyFile == "" {
+		slog.Warn("no jwt key file configured, generating a random key; tokens will not survive a restart")
+	}
+
+	switch cfg.JWTAlgorithm {
+	case encryption.AlgHS256:
+		var secret []byte
+		if cfg.JWTKeyFile != "" {
+			data, err := os.ReadFile(cfg.JWTKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("invalid jwt key file: %w", err)
+			}
+			if secret, err = encryption.ParseHMACKey(string(data)); err != nil {
+				return nil, fmt.Errorf("invalid jwt key file: %w", err)
+			}
+		} else {
+			var err error
+			if secret, err = encryption.GenerateKey(); err != nil {
+				return nil, err
+			}
+		}
+
+		return encryption.NewHS256(secret, cfg.JWTLifetime, cfg.JWTRefreshBefore)
+	case encryption.AlgEdDSA:
+		var key ed25519.PrivateKey
+		if cfg.JWTKeyFile != "" {
+			var err error
+			if key, err = encryption.ReadEd25519Key(cfg.JWTKeyFile); err != nil {
+				return nil, fmt.Errorf("invalid jwt key file: %w", err)
+			}
+		} else {
+			var err error
+			if _, key, err = ed25519.GenerateKey(nil); err != nil {
+				return nil, err
+			}
+		}
+
+		return encryption.NewEdDSA(key, cfg.JWTLifetime, cfg.JWTRefreshBefore)
+	default:
+		return nil, fmt.Errorf("invalid jwt algorithm %q, must be %s or %s", cfg.JWTAlgorithm, encryption.AlgHS256, encryption.AlgEdDSA)
+	}
+}
+
+// newRateLimiters builds the in-memory limiters of the route groups from the rates in cfg.
+func newRateLimiters(cfg config.Config) (handler.RateLimiters, error) {
+	var limiters handler.RateLimiters
+
+	groups := []struct {
+		name    string
+		rate    string
+		limiter *middleware.Limiter
+	}{
+		{"shorten", cfg.RateLimitShorten, &limiters.Shorten},
+		{"batch", cfg.RateLimitBatch, &limiters.Batch},
+		{"redirect", cfg.RateLimitRedirect, &limiters.Redirect},
+		{"delete", cfg.RateLimitDelete, &limiters.Delete},
+		{"auth", cfg.RateLimitAuth, &limiters.Auth},
+	}
+
+	for _, g := range groups {
+		rate, err := middleware.ParseRate(g.rate)
+		if err != nil {
+			return limiters, fmt.Errorf("invalid %s rate limit: %w", g.name, err)
+		}
+
+		if !rate.IsZero() {
+			*g.limiter = middleware.NewMemoryLimiter(rate)
+		}
+	}
+
+	return limiters, nil
+}
+
 // make a function GracefulShutdown
 
 func StartServer(cfg config.Config) error {
+	switch cfg.DedupMode {
+	case util.DedupGlobal, util.DedupPerUser, util.DedupNone:
+	default:
+		return fmt.Errorf("invalid dedup mode %q", cfg.DedupMode)
+	}
+
 	var server *http.Server
 	keysAndLinks := make(map[string]util.MapValue)
 	ctx := context.Background()
@@ -45,12 +202,14 @@ func StartServer(cfg config.Config) error {
 		var err error
 		dbpool, err = pgxpool.Connect(ctx, cfg.DatabaseDSN)
 		if err != nil {
-			fmt.Printf("Unable to connect to database: %v\n", err)
+			slog.Error("unable to connect to database", "error", err)
 			return err
 		}
 		defer dbpool.Close()
 
-		dbStorage := postgres.NewDBStorage(dbpool)
+		metrics.RegisterPgxPool(dbpool)
+
+		dbStorage := postgres.NewDBStorage(dbpool, cfg.DedupMode)
 		storage = dbStorage
 		pinger = dbStorage
 
@@ -58,15 +217,77 @@ func StartServer(cfg config.Config) error {
 		if err != nil {
 			return err
 		}
+
+		rescoped, err := dbStorage.RescopeDedup(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to rescope links for dedup mode %s: %w", cfg.DedupMode, err)
+		}
+		if rescoped > 0 {
+			slog.Info("moved links to the scope of the dedup mode", "mode", cfg.DedupMode, "count", rescoped)
+		}
 	} else {
-		storage = memory.NewStorage(keysAndLinks, cfg.FileStoragePath)
+		memStorage := memory.NewStorage(keysAndLinks, cfg.FileStoragePath, cfg.DedupMode)
+		if err := memStorage.LoadDeleteJobs(); err != nil {
+			return fmt.Errorf("failed to load delete jobs: %w", err)
+		}
+		if err := memStorage.LoadAPIKeys(); err != nil {
+			return fmt.Errorf("failed to load api keys: %w", err)
+		}
+		if err := memStorage.LoadAccounts(); err != nil {
+			return fmt.Errorf("failed to load accounts: %w", err)
+		}
+		storage = memStorage
 	}
 	workerpool := NewWorkerpool(&storage)
+	if err := workerpool.Resume(ctx); err != nil {
+		return fmt.Errorf("failed to resume delete jobs: %w", err)
+	}
+	workerpool.StartSweeper(expiredSweepInterval, cfg.DeletedGracePeriod)
+	metrics.RegisterQueueDepth(func() float64 {
+		return float64(workerpool.QueueDepth())
+	})
+
+	recorder := analytics.NewRecorder(storage, clickBufferSize, clickBatchSize, clickFlushInterval)
+
+	codec, err := newCodec(cfg)
+	if err != nil {
+		return err
+	}
+
+	var trustedSubnet *net.IPNet
+	if cfg.TrustedSubnet != "" {
+		_, trustedSubnet, err = net.ParseCIDR(cfg.TrustedSubnet)
+		if err != nil {
+			return fmt.Errorf("invalid trusted subnet: %w", err)
+		}
+	}
+
+	var trustedProxy *net.IPNet
+	if cfg.TrustedProxy != "" {
+		_, trustedProxy, err = net.ParseCIDR(cfg.TrustedProxy)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy: %w", err)
+		}
+	}
+
+	screener, err := screening.NewScreener(cfg.BlocklistFile, cfg.BaseURL)
+	if err != nil {
+		return fmt.Errorf("invalid blocklist: %w", err)
+	}
+	if err := screener.Watch(); err != nil {
+		return fmt.Errorf("failed to watch blocklist: %w", err)
+	}
+	defer screener.Close()
+
+	c := handler.NewHandler(storage, pinger, cfg.BaseURL, workerpool, recorder, screener)
+	limiters, err := newRateLimiters(cfg)
+	if err != nil {
+		return err
+	}
 
-	c := handler.NewHandler(storage, pinger, cfg.BaseURL, workerpool)
-	r, err := handler.NewRouter(c)
+	r, err := handler.NewRouter(c, codec, trustedSubnet, trustedProxy, limiters)
 	if err != nil {
-		fmt.Printf("Failed to create router: %v\n", err)
+		slog.Error("failed to create router", "error", err)
 		return err
 	}
 
@@ -100,27 +321,77 @@ func StartServer(cfg config.Config) error {
 		return nil
 	}()
 
-	log.Println("server is starting on port ", cfg.ServerAddress)
+	slog.Info("server is starting", "address", cfg.ServerAddress)
+
+	var metricsServer *http.Server
+	if cfg.MetricsAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		metricsServer = &http.Server{Addr: cfg.MetricsAddress, Handler: mux}
+
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				slog.Error("metrics server failed", "error", err)
+			}
+		}()
+
+		slog.Info("metrics server is starting", "address", cfg.MetricsAddress)
+	}
+
+	var grpcServer *grpc.Server
+	if cfg.GRPCAddress != "" {
+		listener, err := net.Listen("tcp", cfg.GRPCAddress)
+		if err != nil {
+			return err
+		}
+
+		grpcServer = grpc.NewServer(grpc.ChainUnaryInterceptor(
+			grpchandler.UserIDInterceptor(codec, storage),
+			grpchandler.RateLimitInterceptor(limiters, trustedProxy),
+		))
+		pb.RegisterShortenerServer(grpcServer, grpchandler.NewServer(storage, pinger, cfg.BaseURL, workerpool, screener))
+
+		go func() {
+			if err := grpcServer.Serve(listener); err != nil {
+				slog.Error("gRPC server failed", "error", err)
+			}
+		}()
+
+		slog.Info("gRPC server is starting", "address", cfg.GRPCAddress)
+	}
 
 	<-done
-	log.Print("Shutdown signal received")
+	slog.Info("shutdown signal received")
 
 	// Stop accepting new requests.
 	ctxShutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	if err := server.Shutdown(ctxShutdown); err != nil && err != http.ErrServerClosed {
-		log.Printf("HTTP server Shutdown: %v", err)
+		slog.Error("HTTP server shutdown failed", "error", err)
+	}
+
+	if grpcServer != nil {
+		grpcServer.GracefulStop()
+	}
+
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(ctxShutdown); err != nil {
+			slog.Error("metrics server shutdown failed", "error", err)
+		}
 	}
 
 	// Finish processing ongoing work and stop the worker pool.
 	workerpool.Stop()
 
+	// Write the clicks that are still buffered.
+	recorder.Close()
+
 	// Close database connections.
 	if dbpool != nil {
 		dbpool.Close()
 	}
 
-	log.Print("Server and Workerpool Gracefully Stopped")
+	slog.Info("server and workerpool gracefully stopped")
 
 	return nil
 }
@@ -2,49 +2,206 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"runtime"
 	"sync"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 
 	"github.com/trunov/go-shortener/internal/app/handler"
+	"github.com/trunov/go-shortener/internal/app/metrics"
+	"github.com/trunov/go-shortener/internal/app/storage"
+	"github.com/trunov/go-shortener/internal/app/util"
 )
 
 type Job interface {
+	Name() string
 	Run(ctx context.Context) error
 }
 
+const (
+	// deleteChunkSize is the number of keys marked as deleted by a single storage call.
+	deleteChunkSize = 100
+
+	// deleteJobRetention is how long the state of a finished delete job is kept.
+	deleteJobRetention = 24 * time.Hour
+
+	// maxDeleteAttempts is how many times a delete job is run before it is marked as failed.
+	maxDeleteAttempts = 5
+)
+
+// deleteRetryBaseDelay is the delay before the first retry; it doubles with every attempt.
+// It is a variable so that tests can shorten it.
+var deleteRetryBaseDelay = time.Second
+
 type Workerpool struct {
-	storage handler.Storager
-	jobs    chan Job
-	wg      sync.WaitGroup
+	storage     handler.Storager
+	jobs        chan Job
+	wg          sync.WaitGroup
+	quit        chan struct{}
+	producersWg sync.WaitGroup
+
+	// stopMtx guards stopped, so that no producer is added to producersWg once Stop waits for it.
+	stopMtx sync.Mutex
+	stopped bool
 }
 
+// DeleteURLSJob runs a delete job persisted in the storage. On failure the job is
+// rescheduled through retry until it has been attempted maxDeleteAttempts times.
+// A job that cannot be read from the storage is retried the same way, counting the
+// failed reads in readFailures since they cannot be recorded in the job itself.
 type DeleteURLSJob struct {
+	storage      handler.Storager
+	id           string
+	retry        func(j *DeleteURLSJob, at time.Time)
+	readFailures int
+}
+
+// DeleteExpiredJob removes the shortened URLs whose expiry has passed.
+type DeleteExpiredJob struct {
+	storage handler.Storager
+}
+
+// PurgeDeletedJob removes the shortened URLs that were deleted more than gracePeriod ago,
+// after which they can no longer be restored.
+type PurgeDeletedJob struct {
 	storage     handler.Storager
-	shortenURLS []string
-	userID      string
+	gracePeriod time.Duration
 }
 
 func NewWorkerpool(storage *handler.Storager) *Workerpool {
 	wp := &Workerpool{
 		storage: *storage,
 		jobs:    make(chan Job, 10),
+		quit:    make(chan struct{}),
 	}
 
-	go wp.runPool(context.Background())
+	// The pool is added to wg before it starts, so that Stop always waits for it.
+	wp.wg.Add(1)
+	go func() {
+		defer wp.wg.Done()
+		wp.runPool(context.Background())
+	}()
 
 	return wp
 }
 
+func (j *DeleteURLSJob) Name() string {
+	return "delete_urls"
+}
+
 func (j *DeleteURLSJob) Run(ctx context.Context) error {
-	fmt.Println("job has started")
-	err := j.storage.DeleteURLS(ctx, j.userID, j.shortenURLS)
+	job, err := j.storage.GetDeleteJob(ctx, j.id)
 	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			j.readFailures++
+			if j.readFailures < maxDeleteAttempts {
+				j.retry(j, time.Now().UTC().Add(retryDelay(j.readFailures)))
+			} else {
+				slog.Error("giving up on delete job until restart", "job_id", j.id, "attempts", j.readFailures)
+			}
+		}
+		return fmt.Errorf("delete job %s: %w", j.id, err)
+	}
+	j.readFailures = 0
+
+	slog.Debug("delete job has started", "job_id", job.ID, "user_id", job.UserID, "keys", len(job.Keys), "attempt", job.Attempts+1)
+
+	job.Status = util.JobRunning
+	job.Attempts++
+	job.NextRunAt = nil
+	if err := j.save(ctx, &job); err != nil {
+		return err
+	}
+
+	deleted, err := j.deleteKeys(ctx, job)
+	job.Deleted += deleted
+	if err != nil {
+		job.Error = err.Error()
+		job.Status = util.JobFailed
+
+		if job.Attempts < maxDeleteAttempts {
+			next := time.Now().UTC().Add(retryDelay(job.Attempts))
+			job.Status = util.JobQueued
+			job.NextRunAt = &next
+		}
+
+		if saveErr := j.save(ctx, &job); saveErr != nil {
+			return saveErr
+		}
+
+		if job.Status == util.JobQueued {
+			j.retry(j, *job.NextRunAt)
+		}
 		return err
 	}
+
+	job.Status = util.JobDone
+	job.Error = ""
+	return j.save(ctx, &job)
+}
+
+// deleteKeys marks the keys of the job as deleted in chunks and returns how many were deleted.
+func (j *DeleteURLSJob) deleteKeys(ctx context.Context, job util.DeleteJob) (int64, error) {
+	var deleted int64
+	for start := 0; start < len(job.Keys); start += deleteChunkSize {
+		end := start + deleteChunkSize
+		if end > len(job.Keys) {
+			end = len(job.Keys)
+		}
+
+		n, err := j.storage.DeleteURLS(ctx, job.UserID, job.Keys[start:end])
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+
+	return deleted, nil
+}
+
+func (j *DeleteURLSJob) save(ctx context.Context, job *util.DeleteJob) error {
+	job.UpdatedAt = time.Now().UTC()
+	return j.storage.SaveDeleteJob(ctx, *job)
+}
+
+// retryDelay returns the exponential backoff before the attempt that follows the given one.
+func retryDelay(attempt int) time.Duration {
+	return deleteRetryBaseDelay << (attempt - 1)
+}
+
+func (j *DeleteExpiredJob) Name() string {
+	return "delete_expired"
+}
+
+func (j *DeleteExpiredJob) Run(ctx context.Context) error {
+	deleted, err := j.storage.DeleteExpired(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if deleted > 0 {
+		slog.Info("removed expired links", "count", deleted)
+	}
+	return nil
+}
+
+func (j *PurgeDeletedJob) Name() string {
+	return "purge_deleted"
+}
+
+func (j *PurgeDeletedJob) Run(ctx context.Context) error {
+	purged, err := j.storage.PurgeDeleted(ctx, time.Now().Add(-j.gracePeriod))
+	if err != nil {
+		return err
+	}
+
+	if purged > 0 {
+		slog.Info("purged deleted links", "count", purged)
+	}
 	return nil
 }
 
@@ -52,9 +209,7 @@ func (w *Workerpool) runPool(ctx context.Context) error {
 	gr, ctx := errgroup.WithContext(ctx)
 
 	for i := 0; i < runtime.GOMAXPROCS(runtime.NumCPU()-1); i++ {
-		w.wg.Add(1)
 		gr.Go(func() error {
-			defer w.wg.Done()
 			for {
 				select {
 				case job, ok := <-w.jobs:
@@ -62,7 +217,8 @@ func (w *Workerpool) runPool(ctx context.Context) error {
 						return nil
 					}
 					if err := job.Run(ctx); err != nil {
-						log.Println(err)
+						metrics.JobFailures.WithLabelValues(job.Name()).Inc()
+						slog.Error("job failed", "job", job.Name(), "error", err)
 					}
 
 				case <-ctx.Done():
@@ -74,17 +230,194 @@ func (w *Workerpool) runPool(ctx context.Context) error {
 	return gr.Wait()
 }
 
-func (w *Workerpool) Start(ctx context.Context, inputCh chan []string, userID string) {
-	for shortenURLs := range inputCh {
-		w.jobs <- &DeleteURLSJob{
-			storage:     w.storage,
-			shortenURLS: shortenURLs,
-			userID:      userID,
+// Submit persists a delete job for the given keys of the user and queues it without blocking the caller.
+func (w *Workerpool) Submit(userID string, keys []string) (util.DeleteJob, error) {
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	job := util.DeleteJob{
+		UserID:    userID,
+		Keys:      keys,
+		Status:    util.JobQueued,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	for {
+		job.ID = util.GenerateRandomString()
+		_, err := w.storage.GetDeleteJob(ctx, job.ID)
+		if errors.Is(err, storage.ErrNotFound) {
+			break
+		}
+		if err != nil {
+			return job, err
 		}
 	}
+
+	if err := w.storage.SaveDeleteJob(ctx, job); err != nil {
+		return job, err
+	}
+
+	w.schedule(job)
+
+	return job, nil
+}
+
+// GetJob returns the current state of the delete job with the given ID.
+func (w *Workerpool) GetJob(id string) (util.DeleteJob, bool) {
+	job, err := w.storage.GetDeleteJob(context.Background(), id)
+	if err != nil {
+		return job, false
+	}
+
+	return job, true
+}
+
+// Resume queues the delete jobs that were left unfinished by a previous run,
+// including the ones interrupted while running.
+func (w *Workerpool) Resume(ctx context.Context) error {
+	jobs, err := w.storage.GetPendingDeleteJobs(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		w.schedule(job)
+	}
+
+	if len(jobs) > 0 {
+		slog.Info("resumed pending delete jobs", "count", len(jobs))
+	}
+
+	return nil
+}
+
+// schedule queues a delete job, waiting until its next attempt is due.
+func (w *Workerpool) schedule(job util.DeleteJob) {
+	at := time.Now()
+	if job.NextRunAt != nil {
+		at = *job.NextRunAt
+	}
+
+	w.scheduleAt(&DeleteURLSJob{storage: w.storage, id: job.ID, retry: w.scheduleAt}, at)
+}
+
+// addProducer registers a goroutine that sends jobs to the workers and reports whether it may
+// start. It returns false once the pool is stopping.
+func (w *Workerpool) addProducer() bool {
+	w.stopMtx.Lock()
+	defer w.stopMtx.Unlock()
+
+	if w.stopped {
+		return false
+	}
+
+	w.producersWg.Add(1)
+	return true
+}
+
+// scheduleAt queues a delete job once at has passed.
+// Once the pool is stopping the job is left in the storage for Resume.
+func (w *Workerpool) scheduleAt(j *DeleteURLSJob, at time.Time) {
+	if !time.Now().Before(at) {
+		w.enqueue(j)
+		return
+	}
+
+	if !w.addProducer() {
+		return
+	}
+
+	go func() {
+		defer w.producersWg.Done()
+
+		timer := time.NewTimer(time.Until(at))
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-w.quit:
+			return
+		}
+
+		select {
+		case w.jobs <- j:
+		case <-w.quit:
+		}
+	}()
+}
+
+// enqueue sends job to the workers in the background, giving up when the pool is stopped.
+func (w *Workerpool) enqueue(job Job) {
+	if !w.addProducer() {
+		return
+	}
+
+	go func() {
+		defer w.producersWg.Done()
+
+		select {
+		case w.jobs <- job:
+		case <-w.quit:
+		}
+	}()
+}
+
+// StartSweeper queues a DeleteExpiredJob every interval until the pool is stopped, followed by
+// a PurgeDeletedJob unless deletedGracePeriod is zero. It also removes the delete jobs that
+// finished more than deleteJobRetention ago.
+func (w *Workerpool) StartSweeper(interval, deletedGracePeriod time.Duration) {
+	if !w.addProducer() {
+		return
+	}
+
+	go func() {
+		defer w.producersWg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := w.storage.PruneDeleteJobs(context.Background(), time.Now().Add(-deleteJobRetention)); err != nil {
+					slog.Error("failed to prune delete jobs", "error", err)
+				}
+
+				jobs := []Job{&DeleteExpiredJob{storage: w.storage}}
+				if deletedGracePeriod > 0 {
+					jobs = append(jobs, &PurgeDeletedJob{storage: w.storage, gracePeriod: deletedGracePeriod})
+				}
+
+				for _, job := range jobs {
+					select {
+					case w.jobs <- job:
+					case <-w.quit:
+						return
+					}
+				}
+			case <-w.quit:
+				return
+			}
+		}
+	}()
 }
 
+// QueueDepth returns the number of jobs waiting to be picked up by a worker.
+func (w *Workerpool) QueueDepth() int {
+	return len(w.jobs)
+}
+
+// Stop waits for the running jobs and stops the pool. Delete jobs that are still
+// queued stay in the storage and are picked up by Resume on the next start.
 func (w *Workerpool) Stop() {
+	w.stopMtx.Lock()
+	w.stopped = true
+	close(w.quit)
+	w.stopMtx.Unlock()
+
+	w.producersWg.Wait()
+
 	close(w.jobs)
 	w.wg.Wait()
 }
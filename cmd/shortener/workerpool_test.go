@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/trunov/go-shortener/internal/app/handler"
+	"github.com/trunov/go-shortener/internal/app/storage/memory"
+	"github.com/trunov/go-shortener/internal/app/util"
+)
+
+// flakyStorage is a memory storage whose DeleteURLS and GetDeleteJob fail a given number of times;
+// GetDeleteJob only fails for existing jobs. A negative number of failures never runs out.
+type flakyStorage struct {
+	*memory.Storage
+
+	mu             sync.Mutex
+	deleteFailures int
+	readFailures   int
+}
+
+var errFlaky = errors.New("storage is unavailable")
+
+func (s *flakyStorage) DeleteURLS(ctx context.Context, userID string, keys []string) (int64, error) {
+	s.mu.Lock()
+	fail := s.deleteFailures != 0
+	if s.deleteFailures > 0 {
+		s.deleteFailures--
+	}
+	s.mu.Unlock()
+
+	if fail {
+		return 0, errFlaky
+	}
+	return s.Storage.DeleteURLS(ctx, userID, keys)
+}
+
+func (s *flakyStorage) GetDeleteJob(ctx context.Context, id string) (util.DeleteJob, error) {
+	job, err := s.Storage.GetDeleteJob(ctx, id)
+	if err != nil {
+		return job, err
+	}
+
+	s.mu.Lock()
+	fail := s.readFailures != 0
+	if s.readFailures > 0 {
+		s.readFailures--
+	}
+	s.mu.Unlock()
+
+	if fail {
+		return util.DeleteJob{}, errFlaky
+	}
+	return job, nil
+}
+
+func newFlakyStorage(t *testing.T, deleteFailures, readFailures int) *flakyStorage {
+	t.Helper()
+
+	prev := deleteRetryBaseDelay
+	deleteRetryBaseDelay = time.Millisecond
+	t.Cleanup(func() { deleteRetryBaseDelay = prev })
+
+	return &flakyStorage{
+		Storage: memory.NewStorage(map[string]util.MapValue{
+			"key1": {Link: "https://example.com/1", UserID: "user1"},
+			"key2": {Link: "https://example.com/2", UserID: "user1"},
+		}, "", util.DedupGlobal),
+		deleteFailures: deleteFailures,
+		readFailures:   readFailures,
+	}
+}
+
+func startWorkerpool(t *testing.T, s handler.Storager) *Workerpool {
+	t.Helper()
+
+	wp := NewWorkerpool(&s)
+	t.Cleanup(wp.Stop)
+	return wp
+}
+
+// waitFinished waits until the delete job is done or failed and returns it.
+func waitFinished(t *testing.T, s *flakyStorage, id string) util.DeleteJob {
+	t.Helper()
+
+	var job util.DeleteJob
+	require.Eventually(t, func() bool {
+		var err error
+		job, err = s.Storage.GetDeleteJob(context.Background(), id)
+		return err == nil && job.IsFinished()
+	}, 5*time.Second, time.Millisecond)
+
+	return job
+}
+
+func Test_retryDelay(t *testing.T) {
+	assert.Equal(t, deleteRetryBaseDelay, retryDelay(1))
+	assert.Equal(t, 2*deleteRetryBaseDelay, retryDelay(2))
+	assert.Equal(t, 8*deleteRetryBaseDelay, retryDelay(4))
+}
+
+func Test_DeleteURLSJobRetries(t *testing.T) {
+	tests := []struct {
+		name           string
+		deleteFailures int
+		readFailures   int
+		wantStatus     string
+		wantAttempts   int
+		wantDeleted    int64
+	}{
+		{
+			name:         "succeeds at once",
+			wantStatus:   util.JobDone,
+			wantAttempts: 1,
+			wantDeleted:  2,
+		},
+		{
+			name:           "succeeds after failed deletes",
+			deleteFailures: 2,
+			wantStatus:     util.JobDone,
+			wantAttempts:   3,
+			wantDeleted:    2,
+		},
+		{
+			name:         "succeeds after failed reads",
+			readFailures: 2,
+			wantStatus:   util.JobDone,
+			wantAttempts: 1,
+			wantDeleted:  2,
+		},
+		{
+			name:           "fails after maxDeleteAttempts",
+			deleteFailures: -1,
+			wantStatus:     util.JobFailed,
+			wantAttempts:   maxDeleteAttempts,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFlakyStorage(t, tt.deleteFailures, tt.readFailures)
+			wp := startWorkerpool(t, s)
+
+			submitted, err := wp.Submit("user1", []string{"key1", "key2"})
+			require.NoError(t, err)
+
+			job := waitFinished(t, s, submitted.ID)
+			assert.Equal(t, tt.wantStatus, job.Status)
+			assert.Equal(t, tt.wantAttempts, job.Attempts)
+			assert.Equal(t, tt.wantDeleted, job.Deleted)
+			assert.Nil(t, job.NextRunAt)
+
+			if tt.wantStatus == util.JobFailed {
+				assert.Equal(t, errFlaky.Error(), job.Error)
+			} else {
+				assert.Empty(t, job.Error)
+			}
+		})
+	}
+}
+
+func Test_WorkerpoolResume(t *testing.T) {
+	s := newFlakyStorage(t, 0, 0)
+	ctx := context.Background()
+
+	soon := time.Now().UTC().Add(10 * time.Millisecond)
+	jobs := []util.DeleteJob{
+		{ID: "queued", UserID: "user1", Keys: []string{"key1"}, Status: util.JobQueued},
+		{ID: "interrupted", UserID: "user1", Keys: []string{"key2"}, Status: util.JobRunning, Attempts: 1},
+		{ID: "backoff", UserID: "user1", Keys: []string{"key1"}, Status: util.JobQueued, Attempts: 2, NextRunAt: &soon},
+		{ID: "finished", UserID: "user1", Keys: []string{"key2"}, Status: util.JobDone, Attempts: 1},
+	}
+	for _, job := range jobs {
+		require.NoError(t, s.SaveDeleteJob(ctx, job))
+	}
+
+	wp := startWorkerpool(t, s)
+	require.NoError(t, wp.Resume(ctx))
+
+	assert.Equal(t, 1, waitFinished(t, s, "queued").Attempts)
+	assert.Equal(t, 2, waitFinished(t, s, "interrupted").Attempts)
+	assert.Equal(t, 3, waitFinished(t, s, "backoff").Attempts)
+
+	finished, err := s.GetDeleteJob(ctx, "finished")
+	require.NoError(t, err)
+	assert.Equal(t, 1, finished.Attempts, "finished jobs are not run again")
+
+	for _, key := range []string{"key1", "key2"} {
+		v, err := s.Get(ctx, key)
+		require.NoError(t, err)
+		assert.True(t, v.IsDeleted, key)
+	}
+}
+
+func Test_WorkerpoolStopWhileRetrying(t *testing.T) {
+	s := newFlakyStorage(t, -1, 0)
+	deleteRetryBaseDelay = 0
+
+	for i := 0; i < 50; i++ {
+		var hs handler.Storager = s
+		wp := NewWorkerpool(&hs)
+
+		_, err := wp.Submit("user1", []string{"key1", "key2"})
+		require.NoError(t, err)
+
+		// Workers keep scheduling retries while the pool stops, which must neither panic nor
+		// add producers after Stop has waited for them.
+		wp.Stop()
+	}
+}
@@ -0,0 +1,96 @@
+// Package analytics buffers click events and writes them to the storage asynchronously,
+// so that recording a click never slows down a redirect.
+package analytics
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/trunov/go-shortener/internal/app/util"
+)
+
+// ClickStorager is the part of the storage that persists click events.
+type ClickStorager interface {
+	AddClicks(ctx context.Context, clicks []util.Click) error
+}
+
+// Recorder collects clicks in a buffered channel and flushes them to the storage
+// in batches, either when batchSize clicks have been collected or every flushInterval.
+type Recorder struct {
+	storage       ClickStorager
+	clicks        chan util.Click
+	done          chan struct{}
+	batchSize     int
+	flushInterval time.Duration
+}
+
+// NewRecorder creates a Recorder and starts its flushing goroutine.
+// bufferSize limits how many clicks may wait in memory; clicks beyond it are dropped.
+func NewRecorder(storage ClickStorager, bufferSize, batchSize int, flushInterval time.Duration) *Recorder {
+	r := &Recorder{
+		storage:       storage,
+		clicks:        make(chan util.Click, bufferSize),
+		done:          make(chan struct{}),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+	}
+
+	go r.run()
+
+	return r
+}
+
+// Record queues a click without blocking. If the buffer is full the click is dropped.
+func (r *Recorder) Record(click util.Click) {
+	select {
+	case r.clicks <- click:
+	default:
+		slog.Warn("click buffer is full, dropping click", "key", click.Key)
+	}
+}
+
+// Close flushes the queued clicks and stops the Recorder.
+// Record must not be called after Close.
+func (r *Recorder) Close() {
+	close(r.clicks)
+	<-r.done
+}
+
+func (r *Recorder) run() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]util.Click, 0, r.batchSize)
+
+	for {
+		select {
+		case click, ok := <-r.clicks:
+			if !ok {
+				r.flush(batch)
+				return
+			}
+
+			batch = append(batch, click)
+			if len(batch) >= r.batchSize {
+				r.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			r.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (r *Recorder) flush(batch []util.Click) {
+	if len(batch) == 0 {
+		return
+	}
+
+	if err := r.storage.AddClicks(context.Background(), batch); err != nil {
+		slog.Error("failed to store clicks", "count", len(batch), "error", err)
+	}
+}
@@ -0,0 +1,51 @@
+// Package apikey generates the API keys that give clients a stable user identity
+// and hashes them for storage.
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+// Prefix starts every API key, so keys can be told apart from other bearer tokens
+// and found by secret scanners.
+const Prefix = "gs_"
+
+// keySize is the number of random bytes in a key.
+const keySize = 32
+
+// displayLength is the number of characters of a key kept in clear to identify it.
+const displayLength = len(Prefix) + 6
+
+// Generate returns a new random API key.
+func Generate() (string, error) {
+	b := make([]byte, keySize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return Prefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// IsKey reports whether token looks like an API key.
+func IsKey(token string) bool {
+	return strings.HasPrefix(token, Prefix)
+}
+
+// Hash returns the hex-encoded SHA-256 hash of key, under which the key is stored.
+// Keys are random, so a fast hash is enough to make the stored value useless on its own.
+func Hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// DisplayPrefix returns the first characters of key, which are stored in clear to identify it.
+func DisplayPrefix(key string) string {
+	if len(key) < displayLength {
+		return key
+	}
+	return key[:displayLength]
+}
@@ -4,7 +4,9 @@ package config
 import (
 	"errors"
 	"flag"
-	"fmt"
+	"log/slog"
+	"strings"
+	"time"
 
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
@@ -17,6 +19,23 @@ const (
 	defaultDatabaseDSN     = ""
 	defaultConfig          = ""
 	defaultEnableHTTPS     = false
+	defaultGRPCAddress     = "localhost:3200"
+	defaultTrustedSubnet   = ""
+	defaultTrustedProxy    = ""
+	defaultCookieKey       = ""
+	defaultCookieKeyFile   = ""
+	defaultLogLevel        = "info"
+	defaultMetricsAddress  = "localhost:2112"
+	defaultDeletedGrace    = 0
+	defaultDedupMode       = "global"
+	defaultBlocklistFile   = ""
+	defaultRateLimit       = ""
+	defaultRateLimitAuth   = "10/1m"
+	defaultTokenFormat     = "encrypted"
+	defaultJWTAlgorithm    = "HS256"
+	defaultJWTKeyFile      = ""
+	defaultJWTLifetime     = 30 * 24 * time.Hour
+	defaultJWTRefresh      = 7 * 24 * time.Hour
 )
 
 func init() {
@@ -26,15 +45,90 @@ func init() {
 	viper.SetDefault("database_dsn", defaultDatabaseDSN)
 	viper.SetDefault("config", defaultConfig)
 	viper.SetDefault("enable_https", defaultEnableHTTPS)
+	viper.SetDefault("grpc_address", defaultGRPCAddress)
+	viper.SetDefault("trusted_subnet", defaultTrustedSubnet)
+	viper.SetDefault("trusted_proxy", defaultTrustedProxy)
+	viper.SetDefault("cookie_key", defaultCookieKey)
+	viper.SetDefault("cookie_key_file", defaultCookieKeyFile)
+	viper.SetDefault("previous_cookie_keys", []string{})
+	viper.SetDefault("log_level", defaultLogLevel)
+	viper.SetDefault("metrics_address", defaultMetricsAddress)
+	viper.SetDefault("deleted_grace_period", defaultDeletedGrace)
+	viper.SetDefault("dedup_mode", defaultDedupMode)
+	viper.SetDefault("blocklist_file", defaultBlocklistFile)
+	viper.SetDefault("rate_limit_shorten", defaultRateLimit)
+	viper.SetDefault("rate_limit_batch", defaultRateLimit)
+	viper.SetDefault("rate_limit_redirect", defaultRateLimit)
+	viper.SetDefault("rate_limit_delete", defaultRateLimit)
+	viper.SetDefault("rate_limit_auth", defaultRateLimitAuth)
+	viper.SetDefault("token_format", defaultTokenFormat)
+	viper.SetDefault("jwt_algorithm", defaultJWTAlgorithm)
+	viper.SetDefault("jwt_key_file", defaultJWTKeyFile)
+	viper.SetDefault("jwt_lifetime", defaultJWTLifetime)
+	viper.SetDefault("jwt_refresh_before", defaultJWTRefresh)
 }
 
-// Config represents the configuration with BaseURL, ServerAddress, FileStoragePath, DatabaseDSN and EnableHTTPS
+// Config represents the configuration with BaseURL, ServerAddress, FileStoragePath, DatabaseDSN, EnableHTTPS,
+// GRPCAddress, TrustedSubnet and the cookie signing keys. An empty GRPCAddress disables the gRPC server and
+// an empty TrustedSubnet denies every request to the internal endpoints.
+//
+// TrustedProxy is the subnet, in CIDR notation, of the reverse proxies whose "X-Real-IP" header is taken
+// as the client address for rate limits, click statistics and the TrustedSubnet check. An empty
+// TrustedProxy ignores the header and uses the address of the connection.
+//
+// CookieKey and PreviousCookieKeys are hex-encoded AES keys. CookieKeyFile points to a file with one
+// hex-encoded key per line, the current key first. If no key is configured a random one is generated
+// on every start. LogLevel is one of "debug", "info", "warn" or "error". MetricsAddress is where
+// /metrics is served, separately from ServerAddress; an empty MetricsAddress disables it.
+//
+// DeletedGracePeriod is how long a deleted link can still be restored before it is purged;
+// zero, the default, keeps deleted links forever. Purging is opt-in because links deleted before
+// the deleted_at column existed are dated to the migration that added it, so any period purges
+// them that long after the upgrade. DedupMode is "global", "per-user" or "none" and decides whether
+// shortening an original URL that was already shortened returns the existing key: for any user,
+// only for its owner, or never.
+//
+// BlocklistFile points to the screening rules checked before a link is created or redirected to,
+// in the format read by screening.Parse; the file is reloaded when it changes.
+//
+// RateLimitShorten, RateLimitBatch, RateLimitRedirect and RateLimitDelete limit the requests of
+// every user or client IP to the matching routes, and RateLimitAuth the account registrations and
+// logins of every client IP, in the form "<requests>/<duration>" read by middleware.ParseRate, for
+// example "60/1m". An empty rate leaves the routes unlimited; only RateLimitAuth has a default rate,
+// so that passwords cannot be guessed at full speed.
+//
+// TokenFormat is "encrypted" for user ID cookies encrypted with the cookie keys, or "jwt" for signed
+// JSON Web Tokens that other services can verify. JWTAlgorithm is "HS256" or "EdDSA" and JWTKeyFile
+// points to the signing key: a hex-encoded secret for HS256 or a PEM-encoded PKCS #8 Ed25519 private
+// key for EdDSA; without it a random key is generated on every start. Tokens are valid for JWTLifetime
+// and are reissued once they expire within JWTRefreshBefore; zero only reissues expired tokens.
 type Config struct {
-	BaseURL         string
-	ServerAddress   string
-	FileStoragePath string
-	DatabaseDSN     string
-	EnableHTTPS     bool
+	BaseURL            string
+	ServerAddress      string
+	FileStoragePath    string
+	DatabaseDSN        string
+	EnableHTTPS        bool
+	GRPCAddress        string
+	TrustedSubnet      string
+	TrustedProxy       string
+	CookieKey          string
+	CookieKeyFile      string
+	PreviousCookieKeys []string
+	LogLevel           string
+	MetricsAddress     string
+	DeletedGracePeriod time.Duration
+	DedupMode          string
+	BlocklistFile      string
+	RateLimitShorten   string
+	RateLimitBatch     string
+	RateLimitRedirect  string
+	RateLimitDelete    string
+	RateLimitAuth      string
+	TokenFormat        string
+	JWTAlgorithm       string
+	JWTKeyFile         string
+	JWTLifetime        time.Duration
+	JWTRefreshBefore   time.Duration
 }
 
 func bindToFlag() {
@@ -44,6 +138,27 @@ func bindToFlag() {
 	pflag.StringP("database_dsn", "d", defaultDatabaseDSN, "database DSN")
 	pflag.StringP("config", "c", defaultConfig, "config file path")
 	pflag.BoolP("enable_https", "s", defaultEnableHTTPS, "enable HTTPS")
+	pflag.StringP("grpc_address", "g", defaultGRPCAddress, "gRPC server address")
+	pflag.StringP("trusted_subnet", "t", defaultTrustedSubnet, "trusted subnet in CIDR notation")
+	pflag.String("trusted_proxy", defaultTrustedProxy, "subnet of the reverse proxies trusted to set X-Real-IP, in CIDR notation")
+	pflag.StringP("cookie_key", "k", defaultCookieKey, "hex-encoded cookie signing key")
+	pflag.String("cookie_key_file", defaultCookieKeyFile, "file with hex-encoded cookie signing keys, current key first")
+	pflag.StringSlice("previous_cookie_keys", []string{}, "comma-separated hex-encoded previous cookie signing keys")
+	pflag.StringP("log_level", "l", defaultLogLevel, "log level: debug, info, warn or error")
+	pflag.StringP("metrics_address", "m", defaultMetricsAddress, "metrics server address")
+	pflag.String("dedup_mode", defaultDedupMode, "scope in which original URLs are deduplicated: global, per-user or none")
+	pflag.String("blocklist_file", defaultBlocklistFile, "file with the block and allow rules for link destinations")
+	pflag.String("rate_limit_shorten", defaultRateLimit, "rate limit of the shorten routes per user, e.g. 60/1m")
+	pflag.String("rate_limit_batch", defaultRateLimit, "rate limit of the batch and stream routes per user, e.g. 10/1m")
+	pflag.String("rate_limit_redirect", defaultRateLimit, "rate limit of redirects per user, e.g. 600/1m")
+	pflag.String("rate_limit_delete", defaultRateLimit, "rate limit of the delete route per user, e.g. 10/1m")
+	pflag.String("rate_limit_auth", defaultRateLimitAuth, "rate limit of the register and login routes per client IP, e.g. 5/1m")
+	pflag.String("token_format", defaultTokenFormat, "format of the user ID tokens: encrypted or jwt")
+	pflag.String("jwt_algorithm", defaultJWTAlgorithm, "signing algorithm of the user ID tokens: HS256 or EdDSA")
+	pflag.String("jwt_key_file", defaultJWTKeyFile, "file with the hex-encoded HS256 secret or the PEM-encoded Ed25519 private key")
+	pflag.Duration("jwt_lifetime", defaultJWTLifetime, "how long user ID tokens are valid")
+	pflag.Duration("jwt_refresh_before", defaultJWTRefresh, "how long before expiry user ID tokens are reissued")
+	pflag.Duration("deleted_grace_period", defaultDeletedGrace, "how long deleted links can be restored before they are purged, 0 to keep them")
 
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 	pflag.Parse()
@@ -57,7 +172,7 @@ func readJSONConfigFile() error {
 		return nil
 	}
 
-	fmt.Println(configPath)
+	slog.Debug("reading config file", "path", configPath)
 
 	viper.SetConfigFile(configPath)
 	err := viper.ReadInConfig()
@@ -77,6 +192,27 @@ func bindToEnv() {
 	viper.BindEnv("database_dsn", "DATABASE_DSN")
 	viper.BindEnv("config", "CONFIG")
 	viper.BindEnv("enable_https", "ENABLE_HTTPS")
+	viper.BindEnv("grpc_address", "GRPC_ADDRESS")
+	viper.BindEnv("trusted_subnet", "TRUSTED_SUBNET")
+	viper.BindEnv("trusted_proxy", "TRUSTED_PROXY")
+	viper.BindEnv("cookie_key", "COOKIE_KEY")
+	viper.BindEnv("cookie_key_file", "COOKIE_KEY_FILE")
+	viper.BindEnv("previous_cookie_keys", "PREVIOUS_COOKIE_KEYS")
+	viper.BindEnv("log_level", "LOG_LEVEL")
+	viper.BindEnv("metrics_address", "METRICS_ADDRESS")
+	viper.BindEnv("deleted_grace_period", "DELETED_GRACE_PERIOD")
+	viper.BindEnv("dedup_mode", "DEDUP_MODE")
+	viper.BindEnv("blocklist_file", "BLOCKLIST_FILE")
+	viper.BindEnv("rate_limit_shorten", "RATE_LIMIT_SHORTEN")
+	viper.BindEnv("rate_limit_batch", "RATE_LIMIT_BATCH")
+	viper.BindEnv("rate_limit_redirect", "RATE_LIMIT_REDIRECT")
+	viper.BindEnv("rate_limit_delete", "RATE_LIMIT_DELETE")
+	viper.BindEnv("rate_limit_auth", "RATE_LIMIT_AUTH")
+	viper.BindEnv("token_format", "TOKEN_FORMAT")
+	viper.BindEnv("jwt_algorithm", "JWT_ALGORITHM")
+	viper.BindEnv("jwt_key_file", "JWT_KEY_FILE")
+	viper.BindEnv("jwt_lifetime", "JWT_LIFETIME")
+	viper.BindEnv("jwt_refresh_before", "JWT_REFRESH_BEFORE")
 }
 
 // ReadConfig reads the configuration from environment variables, flags and json config file.
@@ -94,6 +230,35 @@ func ReadConfig() (Config, error) {
 		FileStoragePath: viper.GetString("file_storage_path"),
 		DatabaseDSN:     viper.GetString("database_dsn"),
 		EnableHTTPS:     viper.GetBool("enable_https"),
+		GRPCAddress:     viper.GetString("grpc_address"),
+		TrustedSubnet:   viper.GetString("trusted_subnet"),
+		TrustedProxy:    viper.GetString("trusted_proxy"),
+		CookieKey:       viper.GetString("cookie_key"),
+		CookieKeyFile:   viper.GetString("cookie_key_file"),
+		LogLevel:        viper.GetString("log_level"),
+		MetricsAddress:  viper.GetString("metrics_address"),
+
+		DeletedGracePeriod: viper.GetDuration("deleted_grace_period"),
+		DedupMode:          viper.GetString("dedup_mode"),
+		BlocklistFile:      viper.GetString("blocklist_file"),
+		RateLimitShorten:   viper.GetString("rate_limit_shorten"),
+		RateLimitBatch:     viper.GetString("rate_limit_batch"),
+		RateLimitRedirect:  viper.GetString("rate_limit_redirect"),
+		RateLimitDelete:    viper.GetString("rate_limit_delete"),
+		RateLimitAuth:      viper.GetString("rate_limit_auth"),
+		TokenFormat:        viper.GetString("token_format"),
+		JWTAlgorithm:       viper.GetString("jwt_algorithm"),
+		JWTKeyFile:         viper.GetString("jwt_key_file"),
+		JWTLifetime:        viper.GetDuration("jwt_lifetime"),
+		JWTRefreshBefore:   viper.GetDuration("jwt_refresh_before"),
+	}
+
+	for _, v := range viper.GetStringSlice("previous_cookie_keys") {
+		for _, key := range strings.Split(v, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				res.PreviousCookieKeys = append(res.PreviousCookieKeys, key)
+			}
+		}
 	}
 
 	return res, nil
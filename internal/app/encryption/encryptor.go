@@ -4,21 +4,44 @@ package encryption
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
 	"encoding/base64"
-	"fmt"
-
-	"github.com/trunov/go-shortener/internal/app/util"
+	"errors"
+	"io"
 )
 
+// GenerateKey returns a new random AES-256 key suitable for NewEncryptor.
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, 2*aes.BlockSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// Codec turns user IDs into the tokens handed out to clients and back.
+// DecodeWithRotation reports with reissue whether the client should be given a new token
+// for the same user ID, for example because the token was made with a previous key.
+// Both Encryptor and JWT implement it.
+type Codec interface {
+	Encode(userID []byte) (string, error)
+	DecodeWithRotation(token string) (userID string, reissue bool, err error)
+}
+
 // Encryptor represents an encryptor with a key for encoding and decoding.
+// Values are always encoded with key, while previous keys are only tried when decoding,
+// which allows to rotate the key without invalidating values encoded with the old one.
 type Encryptor struct {
-	key []byte
+	key      []byte
+	previous [][]byte
 }
 
 // NewEncryptor - constructor for the Encryptor type.
-func NewEncryptor(key []byte) *Encryptor {
+func NewEncryptor(key []byte, previous ...[]byte) *Encryptor {
 	return &Encryptor{
-		key: key,
+		key:      key,
+		previous: previous,
 	}
 }
 
@@ -34,9 +57,10 @@ func (e *Encryptor) Encode(userID []byte) (string, error) {
 		return "GCM", err
 	}
 
-	nonce, err := util.GenerateRandom(gcm.NonceSize())
-	if err != nil {
-		fmt.Println(err.Error())
+	// A nonce must never repeat under the same key, which is shared across replicas and restarts,
+	// so it comes from crypto/rand.
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return "", err
 	}
 
@@ -47,12 +71,34 @@ func (e *Encryptor) Encode(userID []byte) (string, error) {
 
 // Decode decodes the given userID.
 func (e *Encryptor) Decode(userID string) (string, error) {
+	decoded, _, err := e.DecodeWithRotation(userID)
+	return decoded, err
+}
+
+// DecodeWithRotation decodes the given userID, trying the current key first and then each previous key.
+// rotated is true when the value was encoded with a previous key and should be encoded again.
+func (e *Encryptor) DecodeWithRotation(userID string) (decoded string, rotated bool, err error) {
 	b64Decode, err := base64.StdEncoding.DecodeString(userID)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 
-	c, err := aes.NewCipher(e.key)
+	decoded, err = decrypt(e.key, b64Decode)
+	if err == nil {
+		return decoded, false, nil
+	}
+
+	for _, key := range e.previous {
+		if decoded, prevErr := decrypt(key, b64Decode); prevErr == nil {
+			return decoded, true, nil
+		}
+	}
+
+	return "", false, err
+}
+
+func decrypt(key, data []byte) (string, error) {
+	c, err := aes.NewCipher(key)
 	if err != nil {
 		return "Cipher", err
 	}
@@ -63,11 +109,14 @@ func (e *Encryptor) Decode(userID string) (string, error) {
 	}
 
 	nonceSize := gcm.NonceSize()
-	nonce, b64UserID := b64Decode[:nonceSize], b64Decode[nonceSize:]
+	if len(data) < nonceSize {
+		return "", errors.New("encrypted value is too short")
+	}
+
+	nonce, b64UserID := data[:nonceSize], data[nonceSize:]
 
 	decrypted, err := gcm.Open(nil, nonce, b64UserID, nil)
 	if err != nil {
-		fmt.Printf("error: %v\n", err)
 		return "", err
 	}
 
@@ -0,0 +1,119 @@
+package encryption
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_DecodeWithRotation(t *testing.T) {
+	oldKey, err := GenerateKey()
+	require.NoError(t, err)
+	newKey, err := GenerateKey()
+	require.NoError(t, err)
+	otherKey, err := GenerateKey()
+	require.NoError(t, err)
+
+	encodedWithOld, err := NewEncryptor(oldKey).Encode([]byte("user1"))
+	require.NoError(t, err)
+	encodedWithNew, err := NewEncryptor(newKey).Encode([]byte("user1"))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		encryptor   *Encryptor
+		value       string
+		wantUserID  string
+		wantRotated bool
+		wantErr     bool
+	}{
+		{
+			name:       "should decode value encoded with the current key",
+			encryptor:  NewEncryptor(newKey, oldKey),
+			value:      encodedWithNew,
+			wantUserID: "user1",
+		},
+		{
+			name:        "should decode value encoded with a previous key and ask for rotation",
+			encryptor:   NewEncryptor(newKey, oldKey),
+			value:       encodedWithOld,
+			wantUserID:  "user1",
+			wantRotated: true,
+		},
+		{
+			name:      "should fail for value encoded with an unknown key",
+			encryptor: NewEncryptor(otherKey, newKey),
+			value:     encodedWithOld,
+			wantErr:   true,
+		},
+		{
+			name:      "should fail for value shorter than the nonce",
+			encryptor: NewEncryptor(newKey),
+			value:     "YQ==",
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userID, rotated, err := tt.encryptor.DecodeWithRotation(tt.value)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantUserID, userID)
+			assert.Equal(t, tt.wantRotated, rotated)
+		})
+	}
+}
+
+func Test_ReadKeyFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		wantKeys int
+		wantErr  bool
+	}{
+		{
+			name:     "should read current and previous keys",
+			content:  "# current\n000102030405060708090a0b0c0d0e0f000102030405060708090a0b0c0d0e0f\n\n000102030405060708090a0b0c0d0e0f\n",
+			wantKeys: 2,
+		},
+		{
+			name:    "should fail on a key of wrong length",
+			content: "000102\n",
+			wantErr: true,
+		},
+		{
+			name:    "should fail on a key that is not hex",
+			content: "not a key\n",
+			wantErr: true,
+		},
+		{
+			name:    "should fail on a file without keys",
+			content: "# nothing here\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keys")
+			require.NoError(t, os.WriteFile(path, []byte(tt.content), 0600))
+
+			keys, err := ReadKeyFile(path)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Len(t, keys, tt.wantKeys)
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package encryption
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Signing algorithms supported by JWT, as named in the "alg" header.
+const (
+	AlgHS256 = "HS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// minHMACKeySize is the minimum length of an HS256 secret, the size of the SHA-256 output.
+const minHMACKeySize = sha256.Size
+
+// ErrTokenExpired is returned when decoding a JWT whose "exp" claim has passed.
+var ErrTokenExpired = errors.New("token is expired")
+
+// jwtHeader is the JOSE header of the tokens.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// jwtClaims are the claims of the tokens. IssuedAt and ExpiresAt are Unix timestamps.
+type jwtClaims struct {
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// JWT encodes user IDs as signed JSON Web Tokens with the user ID in the "sub" claim,
+// so that other services holding the verification key can trust them. Tokens are valid
+// for lifetime and a token that expires within refreshBefore is reported as to be reissued;
+// a zero refreshBefore never reissues tokens before they expire.
+type JWT struct {
+	alg           string
+	secret        []byte
+	private       ed25519.PrivateKey
+	public        ed25519.PublicKey
+	lifetime      time.Duration
+	refreshBefore time.Duration
+	now           func() time.Time
+}
+
+// NewHS256 returns a JWT that signs tokens with HMAC SHA-256 using secret.
+func NewHS256(secret []byte, lifetime, refreshBefore time.Duration) (*JWT, error) {
+	if len(secret) < minHMACKeySize {
+		return nil, fmt.Errorf("HS256 secret must be at least %d bytes long, got %d", minHMACKeySize, len(secret))
+	}
+
+	return newJWT(&JWT{alg: AlgHS256, secret: secret}, lifetime, refreshBefore)
+}
+
+// NewEdDSA returns a JWT that signs tokens with the Ed25519 key.
+// Other services only need the public half of the key to verify them.
+func NewEdDSA(key ed25519.PrivateKey, lifetime, refreshBefore time.Duration) (*JWT, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, errors.New("invalid Ed25519 private key")
+	}
+
+	return newJWT(&JWT{
+		alg:     AlgEdDSA,
+		private: key,
+		public:  key.Public().(ed25519.PublicKey),
+	}, lifetime, refreshBefore)
+}
+
+func newJWT(j *JWT, lifetime, refreshBefore time.Duration) (*JWT, error) {
+	if lifetime <= 0 {
+		return nil, errors.New("token lifetime must be positive")
+	}
+	if refreshBefore < 0 || refreshBefore >= lifetime {
+		return nil, errors.New("token refresh window must be between zero and the token lifetime")
+	}
+
+	j.lifetime = lifetime
+	j.refreshBefore = refreshBefore
+	j.now = time.Now
+	return j, nil
+}
+
+// Encode returns a new token for userID that expires after the lifetime of j.
+func (j *JWT) Encode(userID []byte) (string, error) {
+	now := j.now()
+
+	header, err := json.Marshal(jwtHeader{Alg: j.alg, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := json.Marshal(jwtClaims{
+		Subject:   string(userID),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(j.lifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(j.sign([]byte(signingInput))), nil
+}
+
+// Decode verifies token and returns the user ID in its "sub" claim.
+func (j *JWT) Decode(token string) (string, error) {
+	userID, _, err := j.DecodeWithRotation(token)
+	return userID, err
+}
+
+// DecodeWithRotation verifies token and returns the user ID in its "sub" claim.
+// reissue is true when the token expires within the refresh window of j.
+// Tokens signed with another algorithm than the one of j are rejected.
+func (j *JWT) DecodeWithRotation(token string) (userID string, reissue bool, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", false, errors.New("token must have three parts")
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", false, fmt.Errorf("invalid token header: %w", err)
+	}
+	if header.Alg != j.alg {
+		return "", false, fmt.Errorf("unexpected token algorithm %q", header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", false, fmt.Errorf("invalid token signature: %w", err)
+	}
+	if !j.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return "", false, errors.New("invalid token signature")
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return "", false, fmt.Errorf("invalid token claims: %w", err)
+	}
+	if claims.Subject == "" {
+		return "", false, errors.New("token has no subject")
+	}
+
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+	now := j.now()
+	if !now.Before(expiresAt) {
+		return "", false, ErrTokenExpired
+	}
+
+	return claims.Subject, expiresAt.Sub(now) <= j.refreshBefore, nil
+}
+
+func (j *JWT) sign(data []byte) []byte {
+	if j.alg == AlgEdDSA {
+		return ed25519.Sign(j.private, data)
+	}
+
+	mac := hmac.New(sha256.New, j.secret)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func (j *JWT) verify(data, signature []byte) bool {
+	if j.alg == AlgEdDSA {
+		return ed25519.Verify(j.public, data, signature)
+	}
+
+	return hmac.Equal(j.sign(data), signature)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,107 @@
+package encryption
+
+import (
+	"crypto/ed25519"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestJWTs(t *testing.T) map[string]*JWT {
+	secret, err := GenerateKey()
+	require.NoError(t, err)
+	hs, err := NewHS256(secret, time.Hour, 10*time.Minute)
+	require.NoError(t, err)
+
+	_, key, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	ed, err := NewEdDSA(key, time.Hour, 10*time.Minute)
+	require.NoError(t, err)
+
+	return map[string]*JWT{AlgHS256: hs, AlgEdDSA: ed}
+}
+
+func Test_JWT(t *testing.T) {
+	for alg, j := range newTestJWTs(t) {
+		t.Run(alg, func(t *testing.T) {
+			now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+			j.now = func() time.Time { return now }
+
+			token, err := j.Encode([]byte("user1"))
+			require.NoError(t, err)
+
+			var claims jwtClaims
+			require.NoError(t, decodeSegment(strings.Split(token, ".")[1], &claims))
+			assert.Equal(t, jwtClaims{Subject: "user1", IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix()}, claims)
+
+			userID, reissue, err := j.DecodeWithRotation(token)
+			require.NoError(t, err)
+			assert.Equal(t, "user1", userID)
+			assert.False(t, reissue)
+
+			now = now.Add(50 * time.Minute)
+			userID, reissue, err = j.DecodeWithRotation(token)
+			require.NoError(t, err)
+			assert.Equal(t, "user1", userID)
+			assert.True(t, reissue, "a token close to expiry should be reissued")
+
+			now = now.Add(10 * time.Minute)
+			_, _, err = j.DecodeWithRotation(token)
+			assert.ErrorIs(t, err, ErrTokenExpired)
+		})
+	}
+}
+
+func Test_JWTRejectsInvalidTokens(t *testing.T) {
+	jwts := newTestJWTs(t)
+	hs, ed := jwts[AlgHS256], jwts[AlgEdDSA]
+
+	hsToken, err := hs.Encode([]byte("user1"))
+	require.NoError(t, err)
+	edToken, err := ed.Encode([]byte("user1"))
+	require.NoError(t, err)
+
+	otherSecret, err := GenerateKey()
+	require.NoError(t, err)
+	other, err := NewHS256(otherSecret, time.Hour, 0)
+	require.NoError(t, err)
+
+	parts := strings.Split(hsToken, ".")
+	forgedClaims := parts[0] + "." + strings.TrimSuffix(parts[1], "x") + "x." + parts[2]
+
+	tests := []struct {
+		name  string
+		codec *JWT
+		token string
+	}{
+		{name: "signed with another key", codec: other, token: hsToken},
+		{name: "signed with another algorithm", codec: hs, token: edToken},
+		{name: "tampered claims", codec: hs, token: forgedClaims},
+		{name: "unsigned", codec: hs, token: parts[0] + "." + parts[1] + "."},
+		{name: "not a jwt", codec: hs, token: "user1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := tt.codec.DecodeWithRotation(tt.token)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func Test_NewJWTValidatesSettings(t *testing.T) {
+	secret, err := GenerateKey()
+	require.NoError(t, err)
+
+	_, err = NewHS256(secret[:16], time.Hour, 0)
+	assert.Error(t, err, "short secret")
+
+	_, err = NewHS256(secret, 0, 0)
+	assert.Error(t, err, "zero lifetime")
+
+	_, err = NewHS256(secret, time.Hour, time.Hour)
+	assert.Error(t, err, "refresh window as long as the lifetime")
+}
@@ -0,0 +1,104 @@
+package encryption
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ParseKey decodes a hex-encoded AES key. The decoded key must be 16, 24 or 32 bytes long.
+func ParseKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("key is not hex-encoded: %w", err)
+	}
+
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("key must be 16, 24 or 32 bytes long, got %d", len(key))
+	}
+}
+
+// ReadKeyFile reads hex-encoded keys from the file at path, one per line.
+// The first key is the current one and the following keys are previous ones.
+// Empty lines and lines starting with '#' are ignored.
+func ReadKeyFile(path string) ([][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys [][]byte
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		key, err := ParseKey(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		keys = append(keys, key)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys found", path)
+	}
+
+	return keys, nil
+}
+
+// ParseHMACKey decodes a hex-encoded HS256 secret.
+func ParseHMACKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("key is not hex-encoded: %w", err)
+	}
+
+	if len(key) < minHMACKeySize {
+		return nil, fmt.Errorf("key must be at least %d bytes long, got %d", minHMACKeySize, len(key))
+	}
+
+	return key, nil
+}
+
+// ReadEd25519Key reads a PEM-encoded PKCS #8 Ed25519 private key from the file at path,
+// as written by "openssl genpkey -algorithm ed25519".
+func ReadEd25519Key(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: no PEM-encoded private key found", path)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 private key", path)
+	}
+
+	return edKey, nil
+}
@@ -0,0 +1,61 @@
+package file
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/trunov/go-shortener/internal/app/util"
+)
+
+// AccountEntry represents a single account in the account file.
+type AccountEntry struct {
+	Username     string    `json:"username"`
+	UserID       string    `json:"userID"`
+	PasswordHash string    `json:"passwordHash"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// ReadAccounts reads the account file and returns the accounts in it by username.
+// A missing file is treated as an empty one.
+func ReadAccounts(filename string) (map[string]util.Account, error) {
+	accounts := make(map[string]util.Account)
+
+	f, err := os.Open(filename)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return accounts, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry AccountEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+
+		accounts[entry.Username] = util.Account(entry)
+	}
+
+	return accounts, scanner.Err()
+}
+
+// AppendAccount appends an account to the account file.
+func AppendAccount(filename string, account util.Account) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(f).Encode(AccountEntry(account)); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
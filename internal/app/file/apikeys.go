@@ -0,0 +1,64 @@
+package file
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/trunov/go-shortener/internal/app/util"
+)
+
+// APIKeyEntry represents a single state of an API key in the key file.
+type APIKeyEntry struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"`
+	UserID    string     `json:"userID"`
+	Hash      string     `json:"hash"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// ReadAPIKeys reads the key file and returns the latest state of every key in it.
+// A missing file is treated as an empty one.
+func ReadAPIKeys(filename string) (map[string]util.APIKey, error) {
+	keys := make(map[string]util.APIKey)
+
+	f, err := os.Open(filename)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return keys, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry APIKeyEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+
+		keys[entry.ID] = util.APIKey(entry)
+	}
+
+	return keys, scanner.Err()
+}
+
+// AppendAPIKey appends a state of an API key to the key file.
+func AppendAPIKey(filename string, key util.APIKey) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(f).Encode(APIKeyEntry(key)); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
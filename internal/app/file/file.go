@@ -6,15 +6,25 @@ import (
 	"bufio"
 	"encoding/json"
 	"os"
+	"time"
 
 	"github.com/trunov/go-shortener/internal/app/util"
 )
 
-// KeyLinkUserID represents the data structure for a key, link and user ID.
+// KeyLinkUserID represents the data structure for a key, link, user ID and the metadata of the link.
+// A key may be written several times; the last entry describes its current state. An entry with
+// IsPurged set records that the key was removed for good.
 type KeyLinkUserID struct {
-	Key    string `json:"key"`
-	Link   string `json:"link"`
-	UserID string `json:"userID"`
+	Key           string     `json:"key"`
+	Link          string     `json:"link"`
+	UserID        string     `json:"userID"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	ExpiresAt     *time.Time `json:"expiresAt,omitempty"`
+	IsDeleted     bool       `json:"isDeleted,omitempty"`
+	DeletedAt     *time.Time `json:"deletedAt,omitempty"`
+	CorrelationID string     `json:"correlationID,omitempty"`
+	IsPurged      bool       `json:"isPurged,omitempty"`
+	DedupExcluded bool       `json:"dedupExcluded,omitempty"`
 }
 
 // reader is responsible for reading KeyLinkUserID data from a file.
@@ -42,9 +52,10 @@ func (c *reader) Close() error {
 }
 
 // ReadLinksAndKeys reads key, link and user ID data from the file and populates
-// the provided map with this data.
+// the provided map with this data. Keys that were purged or have already expired are left out.
 func (c *reader) ReadLinksAndKeys(keysAndLinks map[string]util.MapValue) error {
 	c.scanner.Split(bufio.ScanLines)
+	now := time.Now()
 
 	for c.scanner.Scan() {
 		keyAndLink := KeyLinkUserID{}
@@ -54,7 +65,21 @@ func (c *reader) ReadLinksAndKeys(keysAndLinks map[string]util.MapValue) error {
 			return err
 		}
 
-		keysAndLinks[keyAndLink.Key] = util.MapValue{Link: keyAndLink.Link, UserID: keyAndLink.UserID}
+		if keyAndLink.IsPurged || keyAndLink.ExpiresAt != nil && !now.Before(*keyAndLink.ExpiresAt) {
+			delete(keysAndLinks, keyAndLink.Key)
+			continue
+		}
+
+		keysAndLinks[keyAndLink.Key] = util.MapValue{
+			Link:          keyAndLink.Link,
+			UserID:        keyAndLink.UserID,
+			IsDeleted:     keyAndLink.IsDeleted,
+			DeletedAt:     keyAndLink.DeletedAt,
+			ExpiresAt:     keyAndLink.ExpiresAt,
+			CreatedAt:     keyAndLink.CreatedAt,
+			CorrelationID: keyAndLink.CorrelationID,
+			DedupExcluded: keyAndLink.DedupExcluded,
+		}
 	}
 
 	return nil
@@ -100,8 +125,23 @@ func (p *Writer) Close() error {
 	return p.file.Close()
 }
 
-// WriteKeyLinkUserID writes a single KeyLinkUserID data to the file.
-func (p *Writer) WriteKeyLinkUserID(key, link, userID string) error {
-	keyLinkUserID := KeyLinkUserID{Key: key, Link: link, UserID: userID}
+// WriteKeyLinkUserID writes the current state of a single key to the file.
+func (p *Writer) WriteKeyLinkUserID(key string, v util.MapValue) error {
+	keyLinkUserID := KeyLinkUserID{
+		Key:           key,
+		Link:          v.Link,
+		UserID:        v.UserID,
+		CreatedAt:     v.CreatedAt,
+		ExpiresAt:     v.ExpiresAt,
+		IsDeleted:     v.IsDeleted,
+		DeletedAt:     v.DeletedAt,
+		CorrelationID: v.CorrelationID,
+		DedupExcluded: v.DedupExcluded,
+	}
 	return p.encoder.Encode(keyLinkUserID)
 }
+
+// WritePurgedKey records that key was removed for good, so that it is not read back.
+func (p *Writer) WritePurgedKey(key string) error {
+	return p.encoder.Encode(KeyLinkUserID{Key: key, IsPurged: true})
+}
@@ -0,0 +1,102 @@
+package file
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/trunov/go-shortener/internal/app/util"
+)
+
+// DeleteJobEntry represents a single state of a delete job in the journal file.
+type DeleteJobEntry struct {
+	ID        string     `json:"id"`
+	UserID    string     `json:"userID"`
+	Keys      []string   `json:"keys"`
+	Status    string     `json:"status"`
+	Deleted   int64      `json:"deleted"`
+	Error     string     `json:"error,omitempty"`
+	Attempts  int        `json:"attempts"`
+	NextRunAt *time.Time `json:"nextRunAt,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+}
+
+func newDeleteJobEntry(job util.DeleteJob) DeleteJobEntry {
+	return DeleteJobEntry(job)
+}
+
+func (e DeleteJobEntry) deleteJob() util.DeleteJob {
+	return util.DeleteJob(e)
+}
+
+// ReadDeleteJobs reads the journal file and returns the latest state of every job in it.
+// A missing file is treated as an empty journal.
+func ReadDeleteJobs(filename string) (map[string]util.DeleteJob, error) {
+	jobs := make(map[string]util.DeleteJob)
+
+	f, err := os.Open(filename)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return jobs, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		var entry DeleteJobEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+
+		jobs[entry.ID] = entry.deleteJob()
+	}
+
+	return jobs, scanner.Err()
+}
+
+// AppendDeleteJob appends a state of a job to the journal file.
+func AppendDeleteJob(filename string, job util.DeleteJob) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(f).Encode(newDeleteJobEntry(job)); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// WriteDeleteJobs replaces the journal file with one entry per job.
+// The file is written next to the journal and renamed, so a crash never leaves a partial journal.
+func WriteDeleteJobs(filename string, jobs map[string]util.DeleteJob) error {
+	tmp := filename + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(f)
+	for _, job := range jobs {
+		if err := encoder.Encode(newDeleteJobEntry(job)); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filename)
+}
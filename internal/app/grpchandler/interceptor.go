@@ -0,0 +1,129 @@
+package grpchandler
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/trunov/go-shortener/internal/app/apikey"
+	"github.com/trunov/go-shortener/internal/app/encryption"
+	"github.com/trunov/go-shortener/internal/app/middleware"
+	"github.com/trunov/go-shortener/internal/app/storage"
+	"github.com/trunov/go-shortener/internal/app/util"
+)
+
+// metadataKey is the metadata key that carries the encoded user ID, both in requests and response headers.
+const metadataKey = "user_id"
+
+// authorizationKey is the metadata key that carries an API key.
+const authorizationKey = "authorization"
+
+// userIDKey is the context key under which the decoded user ID is stored.
+type userIDKey struct{}
+
+// apiKeyUserKey is the context key under which UserIDInterceptor records that the user ID was
+// authenticated by an API key.
+type apiKeyUserKey struct{}
+
+// UserIDInterceptor is the gRPC counterpart of middleware.APIKeyAuth and middleware.CookieMiddleware.
+// A request with an API key in the "authorization" metadata, as "Bearer <key>", is authenticated
+// as the user of the key and rejected with Unauthenticated if the key is unknown or revoked.
+// Any other bearer token is decoded with the same codec as the cookie and rejected with
+// Unauthenticated if it is invalid. Otherwise the user ID is decoded from the "user_id" metadata.
+// If the metadata is missing or cannot be decoded, a new user ID is generated and
+// sent back to the client in the "user_id" response header. A token that the codec asks
+// to reissue is sent back encoded again.
+func UserIDInterceptor(codec encryption.Codec, keys middleware.APIKeyStore) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, next grpc.UnaryHandler) (interface{}, error) {
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if values := md.Get(authorizationKey); len(values) > 0 {
+				scheme, token, _ := strings.Cut(values[0], " ")
+				if strings.EqualFold(scheme, "Bearer") && apikey.IsKey(token) {
+					userID, err := keys.GetUserIDByAPIKey(ctx, apikey.Hash(token))
+					if err != nil {
+						if errors.Is(err, storage.ErrNotFound) {
+							return nil, status.Error(codes.Unauthenticated, "invalid api key")
+						}
+						return nil, status.Error(codes.Internal, err.Error())
+					}
+
+					ctx = context.WithValue(ctx, apiKeyUserKey{}, true)
+					return next(context.WithValue(ctx, userIDKey{}, userID), req)
+				}
+
+				if strings.EqualFold(scheme, "Bearer") && token != "" {
+					userID, err := decodeUserID(ctx, codec, token)
+					if err != nil {
+						return nil, status.Error(codes.Unauthenticated, "invalid token")
+					}
+
+					return next(context.WithValue(ctx, userIDKey{}, userID), req)
+				}
+			}
+
+			if values := md.Get(metadataKey); len(values) > 0 {
+				if userID, err := decodeUserID(ctx, codec, values[0]); err == nil {
+					return next(context.WithValue(ctx, userIDKey{}, userID), req)
+				}
+			}
+		}
+
+		userID, err := util.GenerateRandomUserID()
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		if err := sendUserID(ctx, codec, userID); err != nil {
+			return nil, err
+		}
+
+		return next(context.WithValue(ctx, userIDKey{}, userID), req)
+	}
+}
+
+// decodeUserID decodes token with codec and sends it back reissued if the codec asks to.
+func decodeUserID(ctx context.Context, codec encryption.Codec, token string) (string, error) {
+	userID, reissue, err := codec.DecodeWithRotation(token)
+	if err != nil {
+		return "", err
+	}
+
+	if reissue {
+		if err := sendUserID(ctx, codec, userID); err != nil {
+			return "", err
+		}
+	}
+
+	return userID, nil
+}
+
+// sendUserID encodes userID with the current key and sets it as the "user_id" response header.
+func sendUserID(ctx context.Context, codec encryption.Codec, userID string) error {
+	encoded, err := codec.Encode([]byte(userID))
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	if err := grpc.SetHeader(ctx, metadata.Pairs(metadataKey, encoded)); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	return nil
+}
+
+// isAPIKeyUser reports whether UserIDInterceptor authenticated the user ID with an API key.
+func isAPIKeyUser(ctx context.Context) bool {
+	ok, _ := ctx.Value(apiKeyUserKey{}).(bool)
+	return ok
+}
+
+// userIDFromContext returns the user ID stored by UserIDInterceptor.
+func userIDFromContext(ctx context.Context) string {
+	userID, _ := ctx.Value(userIDKey{}).(string)
+	return userID
+}
@@ -0,0 +1,83 @@
+package grpchandler
+
+import (
+	"context"
+	"math"
+	"net"
+	"strconv"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/trunov/go-shortener/internal/app/handler"
+	"github.com/trunov/go-shortener/internal/app/middleware"
+	pb "github.com/trunov/go-shortener/internal/app/proto"
+)
+
+// realIPKey is the metadata key in which a trusted proxy forwards the address of the client.
+const realIPKey = "x-real-ip"
+
+// retryAfterKey is the response header that tells a limited client how many seconds to wait.
+const retryAfterKey = "retry-after"
+
+// RateLimitInterceptor is the gRPC counterpart of middleware.RateLimit. Shorten, ShortenBatch, Get
+// and DeleteUserURLs take their tokens from the limiters of the matching HTTP routes, under the same
+// keys, so a client cannot get around a limit by switching transports. A call over the limit fails
+// with ResourceExhausted and a "retry-after" response header. The "x-real-ip" metadata is only used
+// as the client address when the call comes from trustedProxy; a nil trustedProxy ignores it.
+//
+// The interceptor must be chained after UserIDInterceptor.
+func RateLimitInterceptor(limiters handler.RateLimiters, trustedProxy *net.IPNet) grpc.UnaryServerInterceptor {
+	limits := map[string]middleware.Limiter{
+		pb.Shortener_Shorten_FullMethodName:        limiters.Shorten,
+		pb.Shortener_ShortenBatch_FullMethodName:   limiters.Batch,
+		pb.Shortener_Get_FullMethodName:            limiters.Redirect,
+		pb.Shortener_DeleteUserURLs_FullMethodName: limiters.Delete,
+	}
+
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, next grpc.UnaryHandler) (interface{}, error) {
+		limiter := limits[info.FullMethod]
+		if limiter == nil {
+			return next(ctx, req)
+		}
+
+		key := middleware.RateLimitKey(userIDFromContext(ctx), isAPIKeyUser(ctx), clientIP(ctx, trustedProxy))
+		if ok, retryAfter := middleware.TakeToken(ctx, limiter, key); !ok {
+			_ = grpc.SetHeader(ctx, metadata.Pairs(retryAfterKey, strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))))
+			return nil, status.Error(codes.ResourceExhausted, "too many requests")
+		}
+
+		return next(ctx, req)
+	}
+}
+
+// clientIP returns the address of the peer of the call, or the "x-real-ip" metadata when the
+// peer is in trustedProxy, like middleware.RealIP and util.ClientIP do for HTTP requests.
+func clientIP(ctx context.Context, trustedProxy *net.IPNet) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+
+	ip := p.Addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	if trustedProxy == nil || !trustedProxy.Contains(net.ParseIP(ip)) {
+		return ip
+	}
+
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(realIPKey); len(values) > 0 {
+			if realIP := net.ParseIP(values[0]); realIP != nil {
+				return realIP.String()
+			}
+		}
+	}
+
+	return ip
+}
@@ -0,0 +1,283 @@
+// Package grpchandler exposes the URL shortening operations of the handler package as a gRPC service.
+package grpchandler
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/trunov/go-shortener/internal/app/handler"
+	"github.com/trunov/go-shortener/internal/app/normalize"
+	pb "github.com/trunov/go-shortener/internal/app/proto"
+	"github.com/trunov/go-shortener/internal/app/screening"
+	"github.com/trunov/go-shortener/internal/app/storage"
+	"github.com/trunov/go-shortener/internal/app/storage/postgres"
+	"github.com/trunov/go-shortener/internal/app/util"
+)
+
+// Server implements pb.ShortenerServer on top of the same storage and worker pool as the HTTP handlers.
+type Server struct {
+	pb.UnimplementedShortenerServer
+
+	storage    handler.Storager
+	pinger     postgres.Pinger
+	baseURL    string
+	workerpool handler.Worker
+	screener   handler.Screener
+}
+
+// NewServer initializes a new Server with the provided dependencies.
+// screener may be nil, in which case destinations are not screened.
+func NewServer(storage handler.Storager, pinger postgres.Pinger, baseURL string, workerpool handler.Worker, screener handler.Screener) *Server {
+	return &Server{storage: storage, pinger: pinger, baseURL: baseURL, workerpool: workerpool, screener: screener}
+}
+
+// Shorten creates a short URL, mirroring handler.ShortenJSONLink.
+func (s *Server) Shorten(ctx context.Context, req *pb.ShortenRequest) (*pb.ShortenResponse, error) {
+	userID := userIDFromContext(ctx)
+
+	link, err := handler.CheckURL(req.Url, s.screener)
+	if err != nil {
+		return nil, urlError(err)
+	}
+	req.Url = link
+
+	expiresAt, err := expiration(req.ExpiresAt, req.TtlSeconds).Resolve(time.Now())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	key := util.GenerateRandomString()
+	if req.Alias != "" {
+		if err := handler.ValidateAlias(req.Alias); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		// An expired alias that has not been swept yet is free to be taken again.
+		existing, err := s.storage.Get(ctx, req.Alias)
+		if err == nil && !existing.IsExpired(time.Now()) {
+			if existing.UserID == userID && existing.OriginalURL == req.Url {
+				return &pb.ShortenResponse{Result: s.baseURL + "/" + req.Alias, AlreadyExists: true}, nil
+			}
+
+			return nil, status.Error(codes.AlreadyExists, "alias is already taken")
+		}
+
+		key = req.Alias
+	}
+
+	err = s.storage.Add(ctx, key, req.Url, userID, expiresAt)
+	if err != nil {
+		if req.Alias != "" && errors.Is(err, storage.ErrKeyTaken) {
+			return nil, status.Error(codes.AlreadyExists, "alias is already taken")
+		}
+
+		if errors.Is(err, storage.ErrDuplicateURL) {
+			k, err := s.storage.GetShortenKey(ctx, req.Url, userID)
+			if err != nil {
+				return nil, statusError(err)
+			}
+
+			return &pb.ShortenResponse{Result: s.baseURL + "/" + k, AlreadyExists: true}, nil
+		}
+
+		return nil, statusError(err)
+	}
+
+	return &pb.ShortenResponse{Result: s.baseURL + "/" + key}, nil
+}
+
+// ShortenBatch creates short URLs for several original URLs, mirroring handler.ShortenLinksInBatch.
+func (s *Server) ShortenBatch(ctx context.Context, req *pb.ShortenBatchRequest) (*pb.ShortenBatchResponse, error) {
+	userID := userIDFromContext(ctx)
+
+	batchRes := make([]util.BatchResponse, 0, len(req.Items))
+
+	now := time.Now()
+	for _, v := range req.Items {
+		item := handler.BatchRequest{
+			CorrelationID: v.CorrelationId,
+			OriginalURL:   v.OriginalUrl,
+			Expiration:    expiration(v.ExpiresAt, v.TtlSeconds),
+		}
+		batchRes = append(batchRes, handler.NewBatchItem(item, userID, s.baseURL, s.screener, now))
+	}
+
+	if err := s.storage.AddInBatch(ctx, batchRes, s.baseURL); err != nil {
+		return nil, statusError(err)
+	}
+
+	res := &pb.ShortenBatchResponse{}
+	for _, v := range batchRes {
+		item := &pb.BatchResult{CorrelationId: v.CorrelationID, ShortUrl: v.ShortURL, Status: v.Status, Error: v.Error}
+		if v.ExpiresAt != nil {
+			item.ExpiresAt = timestamppb.New(*v.ExpiresAt)
+		}
+		res.Items = append(res.Items, item)
+	}
+
+	return res, nil
+}
+
+// Get returns the original URL behind a key, mirroring handler.GetURLLink.
+func (s *Server) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse, error) {
+	v, err := s.storage.Get(ctx, req.Key)
+	if err != nil {
+		return nil, statusError(err)
+	}
+
+	if v.IsDeleted || v.IsExpired(time.Now()) {
+		return nil, status.Error(codes.FailedPrecondition, "link is gone")
+	}
+
+	if s.screener != nil {
+		if err := s.screener.Check(v.OriginalURL); err != nil {
+			return nil, status.Error(codes.PermissionDenied, "link is blocked")
+		}
+	}
+
+	return &pb.GetResponse{OriginalUrl: v.OriginalURL}, nil
+}
+
+// GetUserURLs returns the URLs shortened by the caller, mirroring handler.GetUrlsByUserID.
+func (s *Server) GetUserURLs(ctx context.Context, req *pb.GetUserURLsRequest) (*pb.GetUserURLsResponse, error) {
+	opts, err := handler.NewListOptions(int(req.Limit), req.Cursor, req.Sort, req.Deleted, req.Search)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	urls, next, err := s.storage.GetAllLinksByUserID(ctx, userIDFromContext(ctx), s.baseURL, opts)
+	if err != nil {
+		return nil, statusError(err)
+	}
+
+	res := &pb.GetUserURLsResponse{NextCursor: next}
+	for _, v := range urls {
+		u := &pb.UserURL{
+			ShortUrl:      v.ShortURL,
+			OriginalUrl:   v.OriginalURL,
+			CreatedAt:     timestamppb.New(v.CreatedAt),
+			IsDeleted:     v.IsDeleted,
+			Clicks:        v.Clicks,
+			CorrelationId: v.CorrelationID,
+		}
+		if v.ExpiresAt != nil {
+			u.ExpiresAt = timestamppb.New(*v.ExpiresAt)
+		}
+		res.Urls = append(res.Urls, u)
+	}
+
+	return res, nil
+}
+
+// DeleteUserURLs schedules the deletion of the caller's keys, mirroring handler.DeleteHandler.
+func (s *Server) DeleteUserURLs(ctx context.Context, req *pb.DeleteUserURLsRequest) (*pb.DeleteUserURLsResponse, error) {
+	if s.workerpool == nil {
+		return nil, status.Error(codes.Unavailable, "deletion is not available")
+	}
+
+	job, err := s.workerpool.Submit(userIDFromContext(ctx), req.Keys)
+	if err != nil {
+		return nil, statusError(err)
+	}
+
+	return &pb.DeleteUserURLsResponse{Job: deleteJob(job)}, nil
+}
+
+// RestoreUserURLs restores the caller's deleted keys, mirroring handler.RestoreHandler.
+func (s *Server) RestoreUserURLs(ctx context.Context, req *pb.RestoreUserURLsRequest) (*pb.RestoreUserURLsResponse, error) {
+	restored, err := s.storage.RestoreURLS(ctx, userIDFromContext(ctx), req.Keys)
+	if err != nil {
+		return nil, statusError(err)
+	}
+
+	return &pb.RestoreUserURLsResponse{Restored: restored}, nil
+}
+
+// GetDeleteJob returns the state of a delete job of the caller, mirroring handler.GetDeleteJob.
+func (s *Server) GetDeleteJob(ctx context.Context, req *pb.GetDeleteJobRequest) (*pb.DeleteJob, error) {
+	if s.workerpool == nil {
+		return nil, status.Error(codes.Unavailable, "deletion is not available")
+	}
+
+	job, ok := s.workerpool.GetJob(req.Id)
+	if !ok || job.UserID != userIDFromContext(ctx) {
+		return nil, status.Error(codes.NotFound, "job not found")
+	}
+
+	return deleteJob(job), nil
+}
+
+// Ping checks the database connection, mirroring handler.PingDBHandler.
+func (s *Server) Ping(ctx context.Context, _ *pb.PingRequest) (*pb.PingResponse, error) {
+	if s.pinger == nil {
+		return nil, status.Error(codes.Unavailable, "database is not configured")
+	}
+
+	if err := s.pinger.Ping(ctx); err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	return &pb.PingResponse{}, nil
+}
+
+// statusError maps the storage errors to gRPC status codes; any other error is an internal one.
+func statusError(err error) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		code = codes.NotFound
+	case errors.Is(err, storage.ErrConflict):
+		code = codes.AlreadyExists
+	case errors.Is(err, storage.ErrGone):
+		code = codes.FailedPrecondition
+	case errors.Is(err, storage.ErrForbidden):
+		code = codes.PermissionDenied
+	}
+
+	return status.Error(code, err.Error())
+}
+
+// urlError reports a URL rejected by normalize.URL or the screener as an invalid argument,
+// prefixed with the reason.
+func urlError(err error) error {
+	var urlErr *normalize.Error
+	if errors.As(err, &urlErr) {
+		return status.Errorf(codes.InvalidArgument, "%s: %s", urlErr.Reason, urlErr.Message)
+	}
+
+	var screenErr *screening.Error
+	if errors.As(err, &screenErr) {
+		return status.Errorf(codes.InvalidArgument, "%s: %s", screenErr.Reason, screenErr.Message)
+	}
+
+	return status.Error(codes.InvalidArgument, err.Error())
+}
+
+// deleteJob converts a util.DeleteJob to its protobuf representation.
+func deleteJob(job util.DeleteJob) *pb.DeleteJob {
+	return &pb.DeleteJob{
+		Id:        job.ID,
+		Status:    job.Status,
+		Deleted:   job.Deleted,
+		Error:     job.Error,
+		Attempts:  int32(job.Attempts),
+		CreatedAt: timestamppb.New(job.CreatedAt),
+		UpdatedAt: timestamppb.New(job.UpdatedAt),
+	}
+}
+
+// expiration converts the protobuf expiry fields to a handler.Expiration.
+func expiration(expiresAt *timestamppb.Timestamp, ttlSeconds int64) handler.Expiration {
+	e := handler.Expiration{TTLSeconds: ttlSeconds}
+	if expiresAt != nil {
+		t := expiresAt.AsTime()
+		e.ExpiresAt = &t
+	}
+
+	return e
+}
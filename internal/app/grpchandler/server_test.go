@@ -0,0 +1,284 @@
+package grpchandler
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/trunov/go-shortener/internal/app/apikey"
+	"github.com/trunov/go-shortener/internal/app/encryption"
+	"github.com/trunov/go-shortener/internal/app/handler"
+	"github.com/trunov/go-shortener/internal/app/middleware"
+	"github.com/trunov/go-shortener/internal/app/normalize"
+	pb "github.com/trunov/go-shortener/internal/app/proto"
+	"github.com/trunov/go-shortener/internal/app/storage/memory"
+	"github.com/trunov/go-shortener/internal/app/util"
+)
+
+const baseURL = "http://localhost:8080"
+
+type fakeWorker struct {
+	jobs map[string]util.DeleteJob
+}
+
+func (f *fakeWorker) Submit(userID string, keys []string) (util.DeleteJob, error) {
+	job := util.DeleteJob{ID: "job1", UserID: userID, Keys: keys, Status: util.JobQueued}
+	f.jobs[job.ID] = job
+	return job, nil
+}
+
+func (f *fakeWorker) GetJob(id string) (util.DeleteJob, bool) {
+	job, ok := f.jobs[id]
+	return job, ok
+}
+
+func newTestClient(t *testing.T, keysLinksUserID map[string]util.MapValue, worker *fakeWorker) (pb.ShortenerClient, []byte) {
+	t.Helper()
+
+	return newTestClientWithStorage(t, memory.NewStorage(keysLinksUserID, "", util.DedupGlobal), worker)
+}
+
+func newTestClientWithStorage(t *testing.T, storage *memory.Storage, worker *fakeWorker) (pb.ShortenerClient, []byte) {
+	t.Helper()
+
+	key, err := encryption.GenerateKey()
+	require.NoError(t, err)
+
+	listener := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer(grpc.UnaryInterceptor(UserIDInterceptor(encryption.NewEncryptor(key), storage)))
+	pb.RegisterShortenerServer(s, NewServer(storage, nil, baseURL, worker, nil))
+
+	go s.Serve(listener)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.DialContext(
+		context.Background(),
+		"bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return pb.NewShortenerClient(conn), key
+}
+
+func userContext(t *testing.T, key []byte, userID string) context.Context {
+	t.Helper()
+
+	token, err := encryption.NewEncryptor(key).Encode([]byte(userID))
+	require.NoError(t, err)
+
+	return metadata.AppendToOutgoingContext(context.Background(), metadataKey, token)
+}
+
+func Test_Shorten(t *testing.T) {
+	client, key := newTestClient(t, map[string]util.MapValue{
+		"taken": {Link: "https://example.com/other", UserID: "user2"},
+	}, nil)
+	ctx := userContext(t, key, "user1")
+
+	res, err := client.Shorten(ctx, &pb.ShortenRequest{Url: "https://example.com", Alias: "example"})
+	require.NoError(t, err)
+	assert.Equal(t, baseURL+"/example", res.Result)
+	assert.False(t, res.AlreadyExists)
+
+	res, err = client.Shorten(ctx, &pb.ShortenRequest{Url: "https://example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, baseURL+"/example", res.Result)
+	assert.True(t, res.AlreadyExists)
+
+	_, err = client.Shorten(ctx, &pb.ShortenRequest{Url: "https://example.com/sale", Alias: "taken"})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	_, err = client.Shorten(ctx, &pb.ShortenRequest{Url: "https://example.com/sale", Alias: "api"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.Shorten(ctx, &pb.ShortenRequest{Url: "javascript:alert(1)"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), normalize.ReasonSchemeNotAllowed)
+}
+
+func Test_ShortenBatchAndGetUserURLs(t *testing.T) {
+	client, key := newTestClient(t, map[string]util.MapValue{}, nil)
+	ctx := userContext(t, key, "user1")
+
+	batch, err := client.ShortenBatch(ctx, &pb.ShortenBatchRequest{Items: []*pb.BatchItem{
+		{CorrelationId: "1", OriginalUrl: "https://example.com/1"},
+		{CorrelationId: "2", OriginalUrl: "https://example.com/2", TtlSeconds: 60},
+		{CorrelationId: "3", OriginalUrl: "https://example.com/1"},
+		{CorrelationId: "4"},
+	}})
+	require.NoError(t, err)
+	require.Len(t, batch.Items, 4)
+	assert.Equal(t, util.BatchCreated, batch.Items[0].Status)
+	assert.Nil(t, batch.Items[0].ExpiresAt)
+	assert.Equal(t, util.BatchCreated, batch.Items[1].Status)
+	assert.NotNil(t, batch.Items[1].ExpiresAt)
+	assert.Equal(t, util.BatchExisting, batch.Items[2].Status)
+	assert.Equal(t, batch.Items[0].ShortUrl, batch.Items[2].ShortUrl)
+	assert.Equal(t, util.BatchInvalid, batch.Items[3].Status)
+	assert.NotEmpty(t, batch.Items[3].Error)
+
+	urls, err := client.GetUserURLs(ctx, &pb.GetUserURLsRequest{})
+	require.NoError(t, err)
+	assert.Len(t, urls.Urls, 2)
+
+	urls, err = client.GetUserURLs(userContext(t, key, "user2"), &pb.GetUserURLsRequest{})
+	require.NoError(t, err)
+	assert.Empty(t, urls.Urls)
+}
+
+func Test_Get(t *testing.T) {
+	client, _ := newTestClient(t, map[string]util.MapValue{
+		"12345678": {Link: "https://example.com", UserID: "user1"},
+		"deleted1": {Link: "https://example.com/deleted", UserID: "user1", IsDeleted: true},
+	}, nil)
+
+	tests := []struct {
+		name     string
+		key      string
+		wantCode codes.Code
+		wantURL  string
+	}{
+		{name: "should return original url", key: "12345678", wantCode: codes.OK, wantURL: "https://example.com"},
+		{name: "should return NotFound for unknown key", key: "unknown", wantCode: codes.NotFound},
+		{name: "should return FailedPrecondition for deleted key", key: "deleted1", wantCode: codes.FailedPrecondition},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := client.Get(context.Background(), &pb.GetRequest{Key: tt.key})
+			assert.Equal(t, tt.wantCode, status.Code(err))
+			if tt.wantCode == codes.OK {
+				assert.Equal(t, tt.wantURL, res.OriginalUrl)
+			}
+		})
+	}
+}
+
+func Test_DeleteUserURLs(t *testing.T) {
+	worker := &fakeWorker{jobs: make(map[string]util.DeleteJob)}
+	client, key := newTestClient(t, map[string]util.MapValue{}, worker)
+
+	res, err := client.DeleteUserURLs(userContext(t, key, "user1"), &pb.DeleteUserURLsRequest{Keys: []string{"a", "b", "c"}})
+	require.NoError(t, err)
+	assert.Equal(t, "job1", res.Job.Id)
+	assert.Equal(t, util.JobQueued, res.Job.Status)
+
+	assert.Equal(t, "user1", worker.jobs["job1"].UserID)
+	assert.Equal(t, []string{"a", "b", "c"}, worker.jobs["job1"].Keys)
+
+	job, err := client.GetDeleteJob(userContext(t, key, "user1"), &pb.GetDeleteJobRequest{Id: "job1"})
+	require.NoError(t, err)
+	assert.Equal(t, "job1", job.Id)
+
+	_, err = client.GetDeleteJob(userContext(t, key, "user2"), &pb.GetDeleteJobRequest{Id: "job1"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func Test_UserIDInterceptorIssuesToken(t *testing.T) {
+	client, key := newTestClient(t, map[string]util.MapValue{}, nil)
+
+	var header metadata.MD
+	_, err := client.Shorten(context.Background(), &pb.ShortenRequest{Url: "https://example.com"}, grpc.Header(&header))
+	require.NoError(t, err)
+
+	tokens := header.Get(metadataKey)
+	require.Len(t, tokens, 1)
+
+	userID, err := encryption.NewEncryptor(key).Decode(tokens[0])
+	require.NoError(t, err)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), metadataKey, tokens[0])
+	urls, err := client.GetUserURLs(ctx, &pb.GetUserURLsRequest{})
+	require.NoError(t, err)
+	require.Len(t, urls.Urls, 1)
+	assert.NotEmpty(t, userID)
+}
+
+func Test_UserIDInterceptorAPIKey(t *testing.T) {
+	storage := memory.NewStorage(map[string]util.MapValue{
+		"12345678": {Link: "https://example.com", UserID: "ci-user"},
+	}, "", util.DedupGlobal)
+
+	key, err := apikey.Generate()
+	require.NoError(t, err)
+	require.NoError(t, storage.AddAPIKey(context.Background(), util.APIKey{ID: "key1", UserID: "ci-user", Hash: apikey.Hash(key)}))
+
+	client, _ := newTestClientWithStorage(t, storage, nil)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), authorizationKey, "Bearer "+key)
+	urls, err := client.GetUserURLs(ctx, &pb.GetUserURLsRequest{})
+	require.NoError(t, err)
+	require.Len(t, urls.Urls, 1)
+
+	ctx = metadata.AppendToOutgoingContext(context.Background(), authorizationKey, "Bearer "+apikey.Prefix+"unknown")
+	_, err = client.GetUserURLs(ctx, &pb.GetUserURLsRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func Test_Ping(t *testing.T) {
+	client, _ := newTestClient(t, map[string]util.MapValue{}, nil)
+
+	_, err := client.Ping(context.Background(), &pb.PingRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func Test_RateLimitInterceptor(t *testing.T) {
+	_, proxies, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+
+	limiter := middleware.NewMemoryLimiter(middleware.Rate{Requests: 1, Per: time.Minute})
+	interceptor := RateLimitInterceptor(handler.RateLimiters{Shorten: limiter}, proxies)
+
+	call := func(method, addr, realIP, userID string, apiKey bool) error {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(addr), Port: 1234}})
+		if realIP != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(realIPKey, realIP))
+		}
+		ctx = context.WithValue(ctx, userIDKey{}, userID)
+		if apiKey {
+			ctx = context.WithValue(ctx, apiKeyUserKey{}, true)
+		}
+
+		_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		})
+		return err
+	}
+
+	require.NoError(t, call(pb.Shortener_Shorten_FullMethodName, "192.0.2.1", "", "user1", false))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(call(pb.Shortener_Shorten_FullMethodName, "192.0.2.1", "", "user2", false)),
+		"users without an api key are limited by address")
+	assert.Equal(t, codes.ResourceExhausted, status.Code(call(pb.Shortener_Shorten_FullMethodName, "192.0.2.1", "198.51.100.1", "user3", false)),
+		"x-real-ip of an untrusted peer is ignored")
+	assert.NoError(t, call(pb.Shortener_Shorten_FullMethodName, "10.0.0.1", "198.51.100.1", "user3", false),
+		"x-real-ip of a trusted proxy is used")
+	assert.NoError(t, call(pb.Shortener_Ping_FullMethodName, "192.0.2.1", "", "user1", false),
+		"methods without a limiter are not limited")
+
+	require.NoError(t, call(pb.Shortener_Shorten_FullMethodName, "192.0.2.2", "", "user4", true))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(call(pb.Shortener_Shorten_FullMethodName, "192.0.2.3", "", "user4", true)),
+		"api key users are limited across addresses")
+
+	ctx := context.WithValue(context.Background(), userIDKey{}, "user5")
+	key := middleware.RateLimitKey("user5", false, "192.0.2.9")
+	ok, _ := middleware.TakeToken(ctx, limiter, key)
+	require.True(t, ok)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(call(pb.Shortener_Shorten_FullMethodName, "192.0.2.9", "", "user5", false)),
+		"the buckets are shared with the HTTP routes")
+}
@@ -7,6 +7,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/trunov/go-shortener/internal/app/encryption"
 	"github.com/trunov/go-shortener/internal/app/storage/memory"
 	"github.com/trunov/go-shortener/internal/app/storage/postgres"
 	"github.com/trunov/go-shortener/internal/app/util"
@@ -14,11 +15,11 @@ import (
 
 func BenchmarkShortenLink(b *testing.B) {
 	keysLinksUserID := make(map[string]util.MapValue)
-	s := memory.NewStorage(keysLinksUserID, "")
+	s := memory.NewStorage(keysLinksUserID, "", util.DedupGlobal)
 	var p postgres.Pinger
 	baseURL := "http://localhost:8080"
 
-	c := NewHandler(s, p, baseURL, nil)
+	c := NewHandler(s, p, baseURL, nil, nil, nil)
 
 	for i := 0; i < b.N; i++ {
 		request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("https://go.dev/src/net/http/request_test.go"))
@@ -30,12 +31,17 @@ func BenchmarkShortenLink(b *testing.B) {
 
 func BenchmarkGetLink(b *testing.B) {
 	keysLinksUserID := map[string]util.MapValue{"12345678": {Link: "https://go.dev/src/net/http/request_test.go", UserID: "user1"}}
-	s := memory.NewStorage(keysLinksUserID, "")
+	s := memory.NewStorage(keysLinksUserID, "", util.DedupGlobal)
 	var baseURL string
 	var p postgres.Pinger
 
-	c := NewHandler(s, p, baseURL, nil)
-	r, err := NewRouter(c)
+	c := NewHandler(s, p, baseURL, nil, nil, nil)
+	key, err := encryption.GenerateKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	r, err := NewRouter(c, encryption.NewEncryptor(key), nil, nil, RateLimiters{})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -7,6 +7,7 @@ import (
 	"net/http/httptest"
 	"strings"
 
+	"github.com/trunov/go-shortener/internal/app/encryption"
 	"github.com/trunov/go-shortener/internal/app/storage/memory"
 	"github.com/trunov/go-shortener/internal/app/storage/postgres"
 	"github.com/trunov/go-shortener/internal/app/util"
@@ -14,12 +15,17 @@ import (
 
 func ExampleHandler_GetURLLink() {
 	keysLinksUserID := map[string]util.MapValue{"123asd1": {Link: "https://www.example.com", UserID: "user1"}}
-	s := memory.NewStorage(keysLinksUserID, "")
+	s := memory.NewStorage(keysLinksUserID, "", util.DedupGlobal)
 	baseURL := ""
 	var p postgres.Pinger
 
-	h := NewHandler(s, p, baseURL, nil)
-	r, err := NewRouter(h)
+	h := NewHandler(s, p, baseURL, nil, nil, nil)
+	key, err := encryption.GenerateKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	r, err := NewRouter(h, encryption.NewEncryptor(key), nil, nil, RateLimiters{})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -50,11 +56,11 @@ func ExampleHandler_GetURLLink() {
 func ExampleHandler_ShortenLink() {
 	const website = "https://go.dev/src/net/http/request_test.go"
 	keysLinksUserID := make(map[string]util.MapValue)
-	s := memory.NewStorage(keysLinksUserID, "")
+	s := memory.NewStorage(keysLinksUserID, "", util.DedupGlobal)
 	var p postgres.Pinger
 	baseURL := "http://localhost:8080"
 
-	c := NewHandler(s, p, baseURL, nil)
+	c := NewHandler(s, p, baseURL, nil, nil, nil)
 	request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(website))
 
 	w := httptest.NewRecorder()
@@ -2,39 +2,89 @@
 package handler
 
 import (
+	"bufio"
+	"bytes"
 	"context"
-	"crypto/aes"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"mime"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/jackc/pgerrcode"
-
+	"github.com/trunov/go-shortener/internal/app/apikey"
+	"github.com/trunov/go-shortener/internal/app/encryption"
+	"github.com/trunov/go-shortener/internal/app/metrics"
 	"github.com/trunov/go-shortener/internal/app/middleware"
+	"github.com/trunov/go-shortener/internal/app/normalize"
+	"github.com/trunov/go-shortener/internal/app/screening"
+	"github.com/trunov/go-shortener/internal/app/storage"
 	"github.com/trunov/go-shortener/internal/app/storage/postgres"
 	"github.com/trunov/go-shortener/internal/app/util"
 
 	"github.com/go-chi/chi/v5"
 	chiMiddleware "github.com/go-chi/chi/v5/middleware"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // Storager is an interface that outlines the required operations
 // to store, retrieve and manage shortened URLs.
 type Storager interface {
 	Get(ctx context.Context, key string) (util.ShortenerGet, error)
-	Add(ctx context.Context, key, link, userID string) error
-	GetAllLinksByUserID(ctx context.Context, userID, baseURL string) ([]util.AllURLSResponse, error)
-	AddInBatch(ctx context.Context, br []util.BatchResponse, baseURL string) (string, error)
-	GetShortenKey(ctx context.Context, originalURL string) (string, error)
-	DeleteURLS(ctx context.Context, userID string, shortenURLS []string) error
+	Add(ctx context.Context, key, link, userID string, expiresAt *time.Time) error
+	GetAllLinksByUserID(ctx context.Context, userID, baseURL string, opts util.ListOptions) ([]util.AllURLSResponse, string, error)
+	ExportLinksByUserID(ctx context.Context, userID, baseURL string, fn func(util.AllURLSResponse) error) error
+	AddInBatch(ctx context.Context, br []util.BatchResponse, baseURL string) error
+	ImportBatch(ctx context.Context, br []util.BatchResponse, baseURL string) error
+	GetShortenKey(ctx context.Context, originalURL, userID string) (string, error)
+	DeleteURLS(ctx context.Context, userID string, shortenURLS []string) (int64, error)
+	UpdateURL(ctx context.Context, userID, key, originalURL string) error
+	GetRevisions(ctx context.Context, key string) ([]util.Revision, error)
+	RestoreURLS(ctx context.Context, userID string, shortenURLS []string) (int64, error)
+	PurgeDeleted(ctx context.Context, before time.Time) (int64, error)
+	DeleteExpired(ctx context.Context, now time.Time) (int64, error)
+	AddClicks(ctx context.Context, clicks []util.Click) error
+	GetClickStats(ctx context.Context, key string) (util.ClickStats, error)
+	CountURLs(ctx context.Context) (int64, error)
+	CountUsers(ctx context.Context) (int64, error)
+	SaveDeleteJob(ctx context.Context, job util.DeleteJob) error
+	GetDeleteJob(ctx context.Context, id string) (util.DeleteJob, error)
+	GetPendingDeleteJobs(ctx context.Context) ([]util.DeleteJob, error)
+	PruneDeleteJobs(ctx context.Context, before time.Time) (int64, error)
+	AddAPIKey(ctx context.Context, key util.APIKey) error
+	GetAPIKeys(ctx context.Context, userID string) ([]util.APIKey, error)
+	RevokeAPIKey(ctx context.Context, userID, id string) error
+	GetUserIDByAPIKey(ctx context.Context, hash string) (string, error)
+	AddAccount(ctx context.Context, account util.Account) error
+	GetAccount(ctx context.Context, username string) (util.Account, error)
+	ClaimLinks(ctx context.Context, fromUserID, toUserID string) (int64, error)
 }
 
-// Worker is an interface for starting background tasks.
+// Worker is an interface for running the deletion of user's keys in the background
+// and following its progress.
 type Worker interface {
-	Start(ctx context.Context, inputCh chan []string, userID string)
+	Submit(userID string, keys []string) (util.DeleteJob, error)
+	GetJob(id string) (util.DeleteJob, bool)
+}
+
+// ClickRecorder is an interface for recording redirects without blocking the request.
+type ClickRecorder interface {
+	Record(click util.Click)
+}
+
+// Screener is an interface for checking the destination of a link before it is stored
+// and again before redirecting to it.
+type Screener interface {
+	Check(link string) error
 }
 
 // Handler contains all the dependencies to handle HTTP requests for
@@ -44,17 +94,30 @@ type Handler struct {
 	pinger     postgres.Pinger
 	baseURL    string
 	workerpool Worker
+	clicks     ClickRecorder
+	screener   Screener
+}
+
+// Expiration holds the optional expiry of a shortened URL, either as an absolute
+// timestamp or as a number of seconds from now. At most one of them may be set.
+type Expiration struct {
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	TTLSeconds int64      `json:"ttl_seconds,omitempty"`
 }
 
 // BatchRequest represents a single URL shortening request in a batch operation.
 type BatchRequest struct {
 	CorrelationID string `json:"correlation_id"`
 	OriginalURL   string `json:"original_url"`
+	Expiration
 }
 
 // Request represents a request to shorten a given URL.
+// Alias is optional and, when set, is used as the short key instead of a random one.
 type Request struct {
-	URL string `json:"URL"`
+	URL   string `json:"URL"`
+	Alias string `json:"alias,omitempty"`
+	Expiration
 }
 
 // Response provides a shortened URL in response to a shortening request.
@@ -62,9 +125,263 @@ type Response struct {
 	Result string `json:"result"`
 }
 
+// UpdateRequest holds the new original URL of an existing key.
+type UpdateRequest struct {
+	URL string `json:"url"`
+}
+
+// RestoreResponse holds the number of URLs brought back by a restore request.
+type RestoreResponse struct {
+	Restored int64 `json:"restored"`
+}
+
+// AccountRequest holds the credentials sent to register or log in.
+type AccountRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// AccountResponse describes the account the request was signed in to. Claimed is the number
+// of links of the previous user ID that were given to the account, and Token is the value of
+// the "user_id" cookie, for clients that send it in the Authorization header instead.
+type AccountResponse struct {
+	util.Account
+	Claimed int64  `json:"claimed"`
+	Token   string `json:"token"`
+}
+
+// APIKeyRequest holds the optional name of a new API key.
+type APIKeyRequest struct {
+	Name string `json:"name"`
+}
+
+// APIKeyResponse describes a newly created API key. Key is only ever returned here;
+// the storage keeps its hash.
+type APIKeyResponse struct {
+	util.APIKey
+	Key string `json:"key"`
+}
+
+// maxAPIKeyNameLength is the longest name accepted for an API key.
+const maxAPIKeyNameLength = 100
+
+// maxListLimit is the largest page size accepted by GetUrlsByUserID.
+const maxListLimit = 1000
+
+const (
+	// streamChunkSize is the number of lines of an NDJSON import stored at once.
+	streamChunkSize = 1000
+
+	// maxStreamLineSize is the longest line accepted by ShortenLinksStream.
+	maxStreamLineSize = 1 << 20
+)
+
+// NewListOptions validates the listing parameters of a request and converts them to util.ListOptions.
+// A zero limit and an empty cursor, sort or search leave the corresponding option unset.
+func NewListOptions(limit int, cursor, sort string, deleted *bool, search string) (util.ListOptions, error) {
+	opts := util.ListOptions{Limit: limit, Sort: sort, Deleted: deleted, Search: search}
+
+	if limit < 0 || limit > maxListLimit {
+		return opts, fmt.Errorf("limit must be between 1 and %d", maxListLimit)
+	}
+
+	switch sort {
+	case "", util.SortCreatedAsc, util.SortCreatedDesc:
+	default:
+		return opts, fmt.Errorf("sort must be %q or %q", util.SortCreatedAsc, util.SortCreatedDesc)
+	}
+
+	if cursor != "" {
+		c, err := util.DecodeCursor(cursor)
+		if err != nil {
+			return opts, err
+		}
+		opts.Cursor = &c
+	}
+
+	return opts, nil
+}
+
+func parseListOptions(q url.Values) (util.ListOptions, error) {
+	var limit int
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n == 0 {
+			return util.ListOptions{}, fmt.Errorf("limit must be between 1 and %d", maxListLimit)
+		}
+		limit = n
+	}
+
+	var deleted *bool
+	if v := q.Get("deleted"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return util.ListOptions{}, errors.New("deleted must be true or false")
+		}
+		deleted = &b
+	}
+
+	return NewListOptions(limit, q.Get("cursor"), q.Get("sort"), deleted, q.Get("search"))
+}
+
+// ErrorResponse describes why a request could not be fulfilled.
+type ErrorResponse struct {
+	Error  string `json:"error"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// usernamePattern describes the characters and length allowed for a username, after lowercasing.
+var usernamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{2,63}$`)
+
+// minPasswordLength and maxPasswordLength bound the length of a password in bytes;
+// bcrypt ignores everything after the 72nd byte.
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 72
+)
+
+// aliasPattern describes the characters and length allowed for a custom alias.
+var aliasPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{3,64}$`)
+
+// reservedAliases contains the top-level paths already mounted by NewRouter.
+var reservedAliases = map[string]struct{}{
+	"ping":  {},
+	"api":   {},
+	"debug": {},
+}
+
+// ValidateAlias checks that alias can be used as a short key.
+func ValidateAlias(alias string) error {
+	if !aliasPattern.MatchString(alias) {
+		return fmt.Errorf("alias must be 3-64 characters long and contain only letters, digits, '-' or '_'")
+	}
+
+	if _, ok := reservedAliases[strings.ToLower(alias)]; ok {
+		return fmt.Errorf("alias %q is reserved", alias)
+	}
+
+	return nil
+}
+
+// Resolve returns the absolute expiry described by e relative to now, or nil if the link never expires.
+func (e Expiration) Resolve(now time.Time) (*time.Time, error) {
+	if e.ExpiresAt != nil && e.TTLSeconds != 0 {
+		return nil, fmt.Errorf("only one of expires_at and ttl_seconds can be set")
+	}
+
+	if e.TTLSeconds < 0 {
+		return nil, fmt.Errorf("ttl_seconds must be positive")
+	}
+
+	if e.TTLSeconds > 0 {
+		expiresAt := now.Add(time.Duration(e.TTLSeconds) * time.Second).UTC()
+		return &expiresAt, nil
+	}
+
+	if e.ExpiresAt != nil {
+		if !e.ExpiresAt.After(now) {
+			return nil, fmt.Errorf("expires_at must be in the future")
+		}
+
+		expiresAt := e.ExpiresAt.UTC()
+		return &expiresAt, nil
+	}
+
+	return nil, nil
+}
+
+// errorStatus maps the storage errors to HTTP status codes; any other error is an internal one.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, storage.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, storage.ErrGone):
+		return http.StatusGone
+	case errors.Is(err, storage.ErrForbidden):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeError responds with the status code that matches err.
+func writeError(w http.ResponseWriter, err error) {
+	http.Error(w, err.Error(), errorStatus(err))
+}
+
+// writeURLError responds with 400 and the reason why normalize.URL or the screener rejected a URL.
+func writeURLError(w http.ResponseWriter, err error) {
+	res := ErrorResponse{Error: err.Error()}
+
+	var urlErr *normalize.Error
+	var screenErr *screening.Error
+	switch {
+	case errors.As(err, &urlErr):
+		res.Reason = urlErr.Reason
+	case errors.As(err, &screenErr):
+		res.Reason = screenErr.Reason
+	}
+
+	writeJSON(w, http.StatusBadRequest, res)
+}
+
+// getOwned returns the URL behind key, or storage.ErrForbidden if it belongs to another user.
+func (c *Handler) getOwned(ctx context.Context, key, userID string) (util.ShortenerGet, error) {
+	v, err := c.storage.Get(ctx, key)
+	if err != nil {
+		return v, err
+	}
+
+	if v.UserID != userID {
+		return v, storage.ErrForbidden
+	}
+
+	return v, nil
+}
+
+// writeJSON writes v as a JSON body with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 // NewHandler initializes a new Handler with the provided dependencies.
-func NewHandler(storage Storager, pinger postgres.Pinger, baseURL string, workerpool Worker) *Handler {
-	return &Handler{storage: storage, pinger: pinger, baseURL: baseURL, workerpool: workerpool}
+// clicks may be nil, in which case redirects are not recorded, and screener may be nil,
+// in which case destinations are not screened.
+func NewHandler(storage Storager, pinger postgres.Pinger, baseURL string, workerpool Worker, clicks ClickRecorder, screener Screener) *Handler {
+	return &Handler{storage: storage, pinger: pinger, baseURL: baseURL, workerpool: workerpool, clicks: clicks, screener: screener}
+}
+
+// screen checks link with the screener of the handler, if it has one.
+func (c *Handler) screen(link string) error {
+	if c.screener == nil {
+		return nil
+	}
+	return c.screener.Check(link)
+}
+
+// checkURL normalizes link and screens the result.
+func (c *Handler) checkURL(link string) (string, error) {
+	return CheckURL(link, c.screener)
+}
+
+// CheckURL normalizes link and screens the result with screener, which may be nil.
+// It is shared by the HTTP and gRPC handlers.
+func CheckURL(link string, screener Screener) (string, error) {
+	link, err := normalize.URL(link)
+	if err != nil {
+		return "", err
+	}
+
+	if screener != nil {
+		return link, screener.Check(link)
+	}
+	return link, nil
 }
 
 // ShortenJSONLink handles the request to shorten a link provided as JSON.
@@ -78,16 +395,55 @@ func (c *Handler) ShortenJSONLink(w http.ResponseWriter, r *http.Request) {
 
 	userID := r.Context().Value("user_id").(string)
 
-	key := util.GenerateRandomString()
+	link, err := c.checkURL(req.URL)
+	if err != nil {
+		writeURLError(w, err)
+		return
+	}
+	req.URL = link
+
+	expiresAt, err := req.Expiration.Resolve(time.Now())
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
 
 	ctx := context.Background()
-	err := c.storage.Add(ctx, key, req.URL, userID)
+
+	key := util.GenerateRandomString()
+	if req.Alias != "" {
+		if err := ValidateAlias(req.Alias); err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// An expired alias that has not been swept yet is free to be taken again.
+		existing, err := c.storage.Get(ctx, req.Alias)
+		if err == nil && !existing.IsExpired(time.Now()) {
+			if existing.UserID == userID && existing.OriginalURL == req.URL {
+				writeJSON(w, http.StatusConflict, Response{Result: c.baseURL + "/" + req.Alias})
+				return
+			}
+
+			writeJSON(w, http.StatusConflict, ErrorResponse{Error: "alias is already taken"})
+			return
+		}
+
+		key = req.Alias
+	}
+
+	err = c.storage.Add(ctx, key, req.URL, userID, expiresAt)
 
 	w.Header().Set("Content-Type", "application/json")
 
 	if err != nil {
-		if strings.Contains(err.Error(), pgerrcode.UniqueViolation) || strings.Contains(err.Error(), "found entry") {
-			k, err := c.storage.GetShortenKey(ctx, req.URL)
+		if req.Alias != "" && errors.Is(err, storage.ErrKeyTaken) {
+			writeJSON(w, http.StatusConflict, ErrorResponse{Error: "alias is already taken"})
+			return
+		}
+
+		if errors.Is(err, storage.ErrDuplicateURL) {
+			k, err := c.storage.GetShortenKey(ctx, req.URL, userID)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
@@ -126,23 +482,25 @@ func (c *Handler) ShortenLink(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userID, ok := r.Context().Value("user_id").(string)
-
-	// without ok check first test was failing
-	if !ok {
-		fmt.Println("")
+	link, err := c.checkURL(string(b))
+	if err != nil {
+		writeURLError(w, err)
+		return
 	}
 
+	// the user ID is missing when the handler is called without CookieMiddleware
+	userID, _ := r.Context().Value("user_id").(string)
+
 	key := util.GenerateRandomString()
 
 	ctx := context.Background()
-	err = c.storage.Add(ctx, key, string(b), userID)
+	err = c.storage.Add(ctx, key, link, userID, nil)
 
 	w.Header().Set("Content-Type", "plain/text")
 
 	if err != nil {
-		if strings.Contains(err.Error(), pgerrcode.UniqueViolation) || strings.Contains(err.Error(), "found entry") {
-			k, err := c.storage.GetShortenKey(ctx, string(b))
+		if errors.Is(err, storage.ErrDuplicateURL) {
+			k, err := c.storage.GetShortenKey(ctx, link, userID)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
@@ -165,6 +523,7 @@ func (c *Handler) ShortenLink(w http.ResponseWriter, r *http.Request) {
 }
 
 // GetURLLink redirects the user to the original URL using the shortened key.
+// Links whose destination was blocked after they were created return 451.
 func (c *Handler) GetURLLink(w http.ResponseWriter, r *http.Request) {
 	key := chi.URLParam(r, "key")
 
@@ -172,25 +531,144 @@ func (c *Handler) GetURLLink(w http.ResponseWriter, r *http.Request) {
 	v, err := c.storage.Get(ctx, key)
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		if errors.Is(err, storage.ErrNotFound) {
+			metrics.Redirects.WithLabelValues(metrics.RedirectMiss).Inc()
+		}
+		writeError(w, err)
 		return
 	}
 
-	if v.IsDeleted {
+	if v.IsDeleted || v.IsExpired(time.Now()) {
+		metrics.Redirects.WithLabelValues(metrics.RedirectGone).Inc()
 		w.WriteHeader(http.StatusGone)
 		return
 	}
 
+	if err := c.screen(v.OriginalURL); err != nil {
+		metrics.Redirects.WithLabelValues(metrics.RedirectBlocked).Inc()
+		writeJSON(w, http.StatusUnavailableForLegalReasons, ErrorResponse{Error: "link is blocked"})
+		return
+	}
+
+	metrics.Redirects.WithLabelValues(metrics.RedirectHit).Inc()
+
+	if c.clicks != nil {
+		c.clicks.Record(util.Click{
+			Key:       key,
+			ClickedAt: time.Now().UTC(),
+			Referrer:  r.Referer(),
+			UserAgent: r.UserAgent(),
+			IP:        util.TruncateIP(util.ClientIP(r)),
+		})
+	}
+
 	w.Header().Set("Location", v.OriginalURL)
 	w.WriteHeader(http.StatusTemporaryRedirect)
 }
 
-// GetUrlsByUserID retrieves all the URLs shortened by a particular user.
+// GetURLStats returns the click statistics of a shortened URL owned by the user.
+func (c *Handler) GetURLStats(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	userID := r.Context().Value("user_id").(string)
+
+	ctx := context.Background()
+	if _, err := c.getOwned(ctx, key, userID); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	stats, err := c.storage.GetClickStats(ctx, key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// UpdateURL changes the original URL behind a key of the user while keeping the key itself.
+// The previous destination is kept in the revision history of the key.
+func (c *Handler) UpdateURL(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	userID := r.Context().Value("user_id").(string)
+
+	var req UpdateRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	link, err := c.checkURL(req.URL)
+	if err != nil {
+		writeURLError(w, err)
+		return
+	}
+	req.URL = link
+
+	ctx := r.Context()
+	v, err := c.getOwned(ctx, key, userID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if v.IsDeleted || v.IsExpired(time.Now()) {
+		writeError(w, storage.ErrGone)
+		return
+	}
+
+	if v.OriginalURL != req.URL {
+		if err := c.storage.UpdateURL(ctx, userID, key, req.URL); err != nil {
+			if errors.Is(err, storage.ErrDuplicateURL) {
+				writeJSON(w, http.StatusConflict, ErrorResponse{Error: "url is already shortened"})
+				return
+			}
+
+			writeError(w, err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, Response{Result: c.baseURL + "/" + key})
+}
+
+// GetURLHistory returns the earlier destinations of a key owned by the user, oldest first.
+func (c *Handler) GetURLHistory(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	userID := r.Context().Value("user_id").(string)
+
+	ctx := r.Context()
+	if _, err := c.getOwned(ctx, key, userID); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	revisions, err := c.storage.GetRevisions(ctx, key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, revisions)
+}
+
+// GetUrlsByUserID retrieves the URLs shortened by a particular user.
+//
+// The list is narrowed down by the optional query parameters limit, cursor, sort
+// ("created_at" or "-created_at"), deleted ("true" or "false") and search. When there are
+// more URLs than limit, the cursor of the next page is returned in the X-Next-Cursor header.
 func (c *Handler) GetUrlsByUserID(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("user_id").(string)
 
+	opts, err := parseListOptions(r.URL.Query())
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
 	ctx := context.Background()
-	allURLSByUserID, err := c.storage.GetAllLinksByUserID(ctx, userID, c.baseURL)
+	allURLSByUserID, next, err := c.storage.GetAllLinksByUserID(ctx, userID, c.baseURL, opts)
 
 	w.Header().Set("Content-Type", "application/json")
 
@@ -199,6 +677,10 @@ func (c *Handler) GetUrlsByUserID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+
 	if len(allURLSByUserID) == 0 {
 		w.WriteHeader(http.StatusNoContent)
 		return
@@ -210,7 +692,41 @@ func (c *Handler) GetUrlsByUserID(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// ShortenLinksInBatch handles batch requests to shorten multiple links.
+// NewBatchItem validates a single request of a batch made by userID and prepares its result.
+// Valid items get a random short URL under baseURL, invalid ones are rejected and skipped by
+// the storage. screener may be nil. It is shared by the HTTP and gRPC batch endpoints.
+func NewBatchItem(v BatchRequest, userID, baseURL string, screener Screener, now time.Time) util.BatchResponse {
+	br := util.BatchResponse{CorrelationID: v.CorrelationID, OriginalURL: v.OriginalURL, UserID: userID}
+
+	link, urlErr := CheckURL(v.OriginalURL, screener)
+	expiresAt, err := v.Expiration.Resolve(now)
+	switch {
+	case urlErr != nil:
+		br.Reject(urlErr.Error())
+	case err != nil:
+		br.Reject(err.Error())
+	default:
+		br.OriginalURL = link
+		br.ShortURL = baseURL + "/" + util.GenerateRandomString()
+		br.ExpiresAt = expiresAt
+	}
+
+	return br
+}
+
+// batchStatus returns 201 when every item of the batch was created and 207 otherwise.
+func batchStatus(items []util.BatchResponse) int {
+	for _, v := range items {
+		if v.Status != util.BatchCreated {
+			return http.StatusMultiStatus
+		}
+	}
+
+	return http.StatusCreated
+}
+
+// ShortenLinksInBatch handles batch requests to shorten multiple links. It returns one result per
+// request with its status, so a duplicate or invalid item does not fail the rest of the batch.
 func (c *Handler) ShortenLinksInBatch(w http.ResponseWriter, r *http.Request) {
 	var batchReq []BatchRequest
 
@@ -221,47 +737,210 @@ func (c *Handler) ShortenLinksInBatch(w http.ResponseWriter, r *http.Request) {
 
 	userID := r.Context().Value("user_id").(string)
 
-	var batchRes []util.BatchResponse
+	batchRes := make([]util.BatchResponse, 0, len(batchReq))
 
+	now := time.Now()
 	for _, v := range batchReq {
-		key := util.GenerateRandomString()
-		br := util.BatchResponse{CorrelationID: v.CorrelationID, ShortURL: c.baseURL + "/" + key, OriginalURL: v.OriginalURL, UserID: userID}
-		batchRes = append(batchRes, br)
+		batchRes = append(batchRes, NewBatchItem(v, userID, c.baseURL, c.screener, now))
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	if err := c.storage.AddInBatch(r.Context(), batchRes, c.baseURL); err != nil {
+		writeError(w, err)
+		return
+	}
 
-	ctx := context.Background()
-	k, err := c.storage.AddInBatch(ctx, batchRes, c.baseURL)
-	if err != nil {
-		if strings.Contains(err.Error(), pgerrcode.UniqueViolation) || strings.Contains(err.Error(), "found entry") {
-			finalRes := c.baseURL + "/" + k
+	writeJSON(w, batchStatus(batchRes), batchRes)
+}
 
-			w.WriteHeader(http.StatusConflict)
+// ShortenLinksStream handles the import of a newline-delimited JSON stream of BatchRequest values
+// of any size. Lines are stored in chunks of streamChunkSize, and one result line is streamed back
+// for every non-empty input line, in the same order. An error after the first results were sent
+// is reported as a final ErrorResponse line.
+func (c *Handler) ShortenLinksStream(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
 
-			res := Response{Result: finalRes}
-			if err := json.NewEncoder(w).Encode(res); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+	rc := http.NewResponseController(w)
+	// Results are sent while the request body is still being read.
+	if err := rc.EnableFullDuplex(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		writeError(w, err)
+		return
+	}
+
+	started := false
+	enc := json.NewEncoder(w)
+	fail := func(status int, err error) {
+		if !started {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		enc.Encode(ErrorResponse{Error: err.Error()})
+	}
+
+	chunk := make([]util.BatchResponse, 0, streamChunkSize)
+	flush := func() error {
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+
+		if len(chunk) == 0 {
+			return nil
+		}
+
+		if err := c.storage.ImportBatch(r.Context(), chunk, c.baseURL); err != nil {
+			return err
+		}
+
+		for _, v := range chunk {
+			if err := enc.Encode(v); err != nil {
+				return err
+			}
+		}
+		chunk = chunk[:0]
+
+		if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxStreamLineSize)
+
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var item util.BatchResponse
+		var req BatchRequest
+		if err := json.Unmarshal(line, &req); err != nil {
+			item.Reject("invalid json: " + err.Error())
+		} else {
+			item = NewBatchItem(req, userID, c.baseURL, c.screener, time.Now())
+		}
+
+		chunk = append(chunk, item)
+		if len(chunk) == streamChunkSize {
+			if err := flush(); err != nil {
+				fail(errorStatus(err), err)
 				return
 			}
-			return
 		}
+	}
 
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := flush(); err != nil {
+		fail(errorStatus(err), err)
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
+	if err := scanner.Err(); err != nil {
+		fail(http.StatusBadRequest, err)
+	}
+}
 
-	if err := json.NewEncoder(w).Encode(batchRes); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+// exportColumns is the header row of a CSV export.
+var exportColumns = []string{"short_url", "original_url", "created_at", "is_deleted", "expires_at", "clicks", "correlation_id"}
+
+// ExportUserURLs streams every link of the user with its metadata, as CSV with format=csv
+// or as newline-delimited JSON with format=ndjson, the default.
+func (c *Handler) ExportUserURLs(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "ndjson"
+	}
+
+	var contentType string
+	var header func() error
+	var write func(u util.AllURLSResponse) error
+	var flush func() error
+
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		contentType = "text/csv"
+		header = func() error {
+			return cw.Write(exportColumns)
+		}
+		write = func(u util.AllURLSResponse) error {
+			var expiresAt string
+			if u.ExpiresAt != nil {
+				expiresAt = u.ExpiresAt.UTC().Format(time.RFC3339)
+			}
+
+			return cw.Write([]string{
+				u.ShortURL,
+				u.OriginalURL,
+				u.CreatedAt.UTC().Format(time.RFC3339),
+				strconv.FormatBool(u.IsDeleted),
+				expiresAt,
+				strconv.FormatInt(u.Clicks, 10),
+				u.CorrelationID,
+			})
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	case "ndjson":
+		enc := json.NewEncoder(w)
+		contentType = "application/x-ndjson"
+		header = func() error {
+			return nil
+		}
+		write = func(u util.AllURLSResponse) error {
+			return enc.Encode(u)
+		}
+		flush = header
+	default:
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "format must be csv or ndjson"})
 		return
 	}
+
+	// The status is only sent with the first row, so an error before it can still be reported.
+	started := false
+	start := func() error {
+		started = true
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="urls.%s"`, format))
+		w.WriteHeader(http.StatusOK)
+
+		return header()
+	}
+
+	err := c.storage.ExportLinksByUserID(r.Context(), userID, c.baseURL, func(u util.AllURLSResponse) error {
+		if !started {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		return write(u)
+	})
+	if err == nil && !started {
+		err = start()
+	}
+	if err == nil {
+		err = flush()
+	}
+
+	if err != nil {
+		if !started {
+			writeError(w, err)
+			return
+		}
+		slog.Error("failed to export user urls", "user_id", userID, "error", err)
+	}
 }
 
 // DeleteHandler handles the request to delete specific shortened links.
+// The deletion runs in the background; the response contains the job that can be
+// followed with GetDeleteJob.
 func (c *Handler) DeleteHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
 	userID := r.Context().Value("user_id").(string)
 
 	var arr []string
@@ -271,11 +950,235 @@ func (c *Handler) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	inputCh := util.GenerateChannel(arr)
-	go c.workerpool.Start(ctx, inputCh, userID)
+	job, err := c.workerpool.Submit(userID, arr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// RestoreHandler restores the deleted URLs of the user that have not been purged yet.
+func (c *Handler) RestoreHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	var arr []string
+
+	if err := json.NewDecoder(r.Body).Decode(&arr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	restored, err := c.storage.RestoreURLS(r.Context(), userID, arr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, RestoreResponse{Restored: restored})
+}
+
+// CreateAPIKey creates an API key for the user. The key is returned once, in the response,
+// and authenticates later requests as the same user when sent as "Authorization: Bearer".
+func (c *Handler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	var req APIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Name) > maxAPIKeyNameLength {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("name must be at most %d characters", maxAPIKeyNameLength)})
+		return
+	}
+
+	key, err := apikey.Generate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res := APIKeyResponse{
+		APIKey: util.APIKey{
+			ID:        util.GenerateRandomString(),
+			Name:      req.Name,
+			Prefix:    apikey.DisplayPrefix(key),
+			UserID:    userID,
+			Hash:      apikey.Hash(key),
+			CreatedAt: time.Now().UTC(),
+		},
+		Key: key,
+	}
+
+	if err := c.storage.AddAPIKey(r.Context(), res.APIKey); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, res)
+}
+
+// GetAPIKeys lists the API keys of the user, without the keys themselves.
+func (c *Handler) GetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	keys, err := c.storage.GetAPIKeys(r.Context(), userID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if len(keys) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, keys)
+}
+
+// RevokeAPIKey revokes an API key of the user, after which it no longer authenticates requests.
+func (c *Handler) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	if err := c.storage.RevokeAPIKey(r.Context(), userID, chi.URLParam(r, "id")); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readCredentials decodes the credentials of an account request and lowercases the username.
+// The request must be sent as application/json: browsers cannot send that content type across
+// sites without a CORS preflight, so another site cannot sign a visitor in to an account it
+// controls and collect the visitor's links. It writes the error response and returns false if
+// the request is invalid.
+func readCredentials(w http.ResponseWriter, r *http.Request) (AccountRequest, bool) {
+	var req AccountRequest
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		http.Error(w, "content type must be application/json", http.StatusUnsupportedMediaType)
+		return req, false
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return req, false
+	}
+
+	req.Username = strings.ToLower(strings.TrimSpace(req.Username))
+	return req, true
+}
+
+// signIn gives the links of the user ID of the request to account and issues the cookie of
+// the account, so that the client continues as the account.
+func (c *Handler) signIn(w http.ResponseWriter, r *http.Request, codec encryption.Codec, account util.Account, status int) {
+	userID := r.Context().Value("user_id").(string)
+
+	claimed, err := c.storage.ClaimLinks(r.Context(), userID, account.UserID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	token, err := middleware.SetUserIDCookie(w, codec, account.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, status, AccountResponse{Account: account, Claimed: claimed, Token: token})
+}
+
+// Register returns a handler that creates an account with a username and password and signs
+// the request in to it. The links and API keys of the current user ID are given to the account
+// and the "user_id" cookie is replaced by the one of the account. codec encodes the cookie.
+// The request must be sent as application/json.
+func (c *Handler) Register(codec encryption.Codec) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, ok := readCredentials(w, r)
+		if !ok {
+			return
+		}
+
+		if !usernamePattern.MatchString(req.Username) {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "username must be 3 to 64 letters, digits, '.', '_' or '-'"})
+			return
+		}
+
+		if len(req.Password) < minPasswordLength || len(req.Password) > maxPasswordLength {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("password must be %d to %d bytes long", minPasswordLength, maxPasswordLength)})
+			return
+		}
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		userID, err := util.GenerateRandomUserID()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		account := util.Account{
+			Username:     req.Username,
+			UserID:       userID,
+			PasswordHash: string(hash),
+			CreatedAt:    time.Now().UTC(),
+		}
+
+		if err := c.storage.AddAccount(r.Context(), account); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		c.signIn(w, r, codec, account, http.StatusCreated)
+	}
+}
+
+// Login returns a handler that checks the username and password of an account and signs the
+// request in to it like Register does, giving it the links of the current user ID. Unknown
+// usernames and wrong passwords are both rejected with 401 Unauthorized.
+func (c *Handler) Login(codec encryption.Codec) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, ok := readCredentials(w, r)
+		if !ok {
+			return
+		}
+
+		account, err := c.storage.GetAccount(r.Context(), req.Username)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			writeError(w, err)
+			return
+		}
+
+		if err != nil || bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(req.Password)) != nil {
+			http.Error(w, "invalid username or password", http.StatusUnauthorized)
+			return
+		}
+
+		c.signIn(w, r, codec, account, http.StatusOK)
+	}
+}
+
+// GetDeleteJob returns the state of a delete job started by the user.
+func (c *Handler) GetDeleteJob(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	job, ok := c.workerpool.GetJob(chi.URLParam(r, "id"))
+	if !ok || job.UserID != userID {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, job)
 }
 
 // PingDBHandler checks the health of the connected database.
@@ -294,33 +1197,98 @@ func (c *Handler) PingDBHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// NewRouter sets up and returns a new router with all the URL shortening routes configured.
-func NewRouter(c *Handler) (chi.Router, error) {
-	r := chi.NewRouter()
+// GetInternalStats returns the number of shortened URLs and distinct users.
+func (c *Handler) GetInternalStats(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
 
-	key, err := util.GenerateRandom(2 * aes.BlockSize)
+	urls, err := c.storage.CountURLs(ctx)
 	if err != nil {
-		return nil, err
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
+	users, err := c.storage.CountUsers(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, util.InternalStats{URLs: urls, Users: users})
+}
+
+// RateLimiters holds the limiter of every group of rate limited routes. A nil limiter
+// leaves its group unlimited. grpchandler.RateLimitInterceptor applies the same limiters
+// to the matching gRPC methods.
+type RateLimiters struct {
+	// Shorten limits POST / and POST /api/shorten.
+	Shorten middleware.Limiter
+	// Batch limits POST /api/shorten/batch and POST /api/shorten/stream.
+	Batch middleware.Limiter
+	// Redirect limits GET /{key}.
+	Redirect middleware.Limiter
+	// Delete limits DELETE /api/user/urls.
+	Delete middleware.Limiter
+	// Auth limits POST /api/user/register and POST /api/user/login per client IP.
+	Auth middleware.Limiter
+}
+
+// NewRouter sets up and returns a new router with all the URL shortening routes configured.
+// codec encodes and decodes the user ID cookie or bearer token, and trustedSubnet guards the
+// internal endpoints; a nil trustedSubnet denies access to them. The X-Real-IP header is only
+// trusted from trustedProxy; a nil trustedProxy ignores it. limiters sets the rate limits of the
+// route groups.
+func NewRouter(c *Handler, codec encryption.Codec, trustedSubnet, trustedProxy *net.IPNet, limiters RateLimiters) (chi.Router, error) {
+	r := chi.NewRouter()
+
+	r.Use(middleware.RealIP(trustedProxy))
+	r.Use(chiMiddleware.RequestID)
+	r.Use(middleware.Metrics)
 	r.Use(middleware.GzipHandle)
 	r.Use(middleware.DecompressHandle)
-	r.Use(middleware.CookieMiddleware(key))
+	r.Use(middleware.RequestLogger(slog.Default()))
+	r.Use(middleware.APIKeyAuth(c.storage))
+	r.Use(middleware.CookieMiddleware(codec))
 	r.Mount("/debug", chiMiddleware.Profiler())
 
-	r.Post("/", c.ShortenLink)
-	r.Get("/{key}", c.GetURLLink)
+	shortenLimit := middleware.RateLimit(limiters.Shorten)
+	batchLimit := middleware.RateLimit(limiters.Batch)
+
+	r.With(shortenLimit).Post("/", c.ShortenLink)
+	r.With(middleware.RateLimit(limiters.Redirect)).Get("/{key}", c.GetURLLink)
 	r.Get("/ping", c.PingDBHandler)
 
 	r.Route("/api", func(r chi.Router) {
 		r.Route("/user/urls", func(r chi.Router) {
 			r.Get("/", c.GetUrlsByUserID)
-			r.Delete("/", c.DeleteHandler)
+			r.With(middleware.RateLimit(limiters.Delete)).Delete("/", c.DeleteHandler)
+			r.Post("/restore", c.RestoreHandler)
+			r.Get("/export", c.ExportUserURLs)
+			r.Patch("/{key}", c.UpdateURL)
+			r.Get("/{key}/stats", c.GetURLStats)
+			r.Get("/{key}/history", c.GetURLHistory)
 		})
 
+		r.Get("/user/jobs/{id}", c.GetDeleteJob)
+
+		r.Route("/user/keys", func(r chi.Router) {
+			r.Post("/", c.CreateAPIKey)
+			r.Get("/", c.GetAPIKeys)
+			r.Delete("/{id}", c.RevokeAPIKey)
+		})
+
+		authLimit := middleware.RateLimitByIP(limiters.Auth)
+		r.With(authLimit).Post("/user/register", c.Register(codec))
+		r.With(authLimit).Post("/user/login", c.Login(codec))
+
 		r.Route("/shorten", func(r chi.Router) {
-			r.Post("/", c.ShortenJSONLink)
-			r.Post("/batch", c.ShortenLinksInBatch)
+			r.With(shortenLimit).Post("/", c.ShortenJSONLink)
+			r.With(batchLimit).Post("/batch", c.ShortenLinksInBatch)
+			r.With(batchLimit).Post("/stream", c.ShortenLinksStream)
+		})
+
+		r.Route("/internal", func(r chi.Router) {
+			r.Use(middleware.TrustedSubnet(trustedSubnet))
+			r.Get("/stats", c.GetInternalStats)
 		})
 	})
 
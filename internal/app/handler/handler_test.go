@@ -1,17 +1,31 @@
 package handler
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/trunov/go-shortener/internal/app/encryption"
+	"github.com/trunov/go-shortener/internal/app/file"
+	"github.com/trunov/go-shortener/internal/app/normalize"
+	"github.com/trunov/go-shortener/internal/app/screening"
+	"github.com/trunov/go-shortener/internal/app/storage"
 	"github.com/trunov/go-shortener/internal/app/storage/memory"
 	"github.com/trunov/go-shortener/internal/app/storage/postgres"
 	"github.com/trunov/go-shortener/internal/app/util"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -41,11 +55,11 @@ func Test_ShortenLink(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			keysLinksUserID := make(map[string]util.MapValue)
-			s := memory.NewStorage(keysLinksUserID, "")
+			s := memory.NewStorage(keysLinksUserID, "", util.DedupGlobal)
 			var p postgres.Pinger
 			baseURL := "http://localhost:8080"
 
-			c := NewHandler(s, p, baseURL, nil)
+			c := NewHandler(s, p, baseURL, nil, nil, nil)
 			request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.website))
 
 			w := httptest.NewRecorder()
@@ -66,6 +80,8 @@ func Test_ShortenLink(t *testing.T) {
 }
 
 func Test_GetLink(t *testing.T) {
+	expired := time.Now().Add(-time.Hour)
+
 	type want struct {
 		statusCode int
 		url        string
@@ -95,18 +111,30 @@ func Test_GetLink(t *testing.T) {
 			keysLinksUserID: map[string]util.MapValue{"123asd1": {Link: "https://go.dev/src/net/http/request_test.go", UserID: "user1"}},
 			key:             "21323",
 		},
+		{
+			name: "should return 410 Gone for expired link",
+			want: want{
+				statusCode: http.StatusGone,
+				url:        "",
+			},
+			keysLinksUserID: map[string]util.MapValue{"12345678": {Link: "https://go.dev/src/net/http/request_test.go", UserID: "user1", ExpiresAt: &expired}},
+			key:             "12345678",
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			s := memory.NewStorage(tt.keysLinksUserID, "")
+			s := memory.NewStorage(tt.keysLinksUserID, "", util.DedupGlobal)
 
 			var baseURL string
 			var p postgres.Pinger
 
-			c := NewHandler(s, p, baseURL, nil)
+			c := NewHandler(s, p, baseURL, nil, nil, nil)
+
+			key, err := encryption.GenerateKey()
+			require.NoError(t, err)
 
-			r, err := NewRouter(c)
+			r, err := NewRouter(c, encryption.NewEncryptor(key), nil, nil, RateLimiters{})
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -129,3 +157,1548 @@ func Test_GetLink(t *testing.T) {
 	}
 
 }
+
+func Test_ShortenJSONLinkAlias(t *testing.T) {
+	type want struct {
+		code   int
+		result string
+		error  string
+	}
+
+	tests := []struct {
+		name            string
+		want            want
+		keysLinksUserID map[string]util.MapValue
+		body            string
+	}{
+		{
+			name: "should return 201 and short url with alias",
+			want: want{
+				code:   http.StatusCreated,
+				result: "http://localhost:8080/spring-sale",
+			},
+			keysLinksUserID: map[string]util.MapValue{},
+			body:            `{"URL":"https://example.com/sale","alias":"spring-sale"}`,
+		},
+		{
+			name: "should return 400 for alias with invalid characters",
+			want: want{
+				code: http.StatusBadRequest,
+			},
+			keysLinksUserID: map[string]util.MapValue{},
+			body:            `{"URL":"https://example.com/sale","alias":"spring sale!"}`,
+		},
+		{
+			name: "should return 400 for reserved alias",
+			want: want{
+				code: http.StatusBadRequest,
+			},
+			keysLinksUserID: map[string]util.MapValue{},
+			body:            `{"URL":"https://example.com/sale","alias":"ping"}`,
+		},
+		{
+			name: "should return 409 with error when alias belongs to another user",
+			want: want{
+				code:  http.StatusConflict,
+				error: "alias is already taken",
+			},
+			keysLinksUserID: map[string]util.MapValue{"spring-sale": {Link: "https://example.com/other", UserID: "user2"}},
+			body:            `{"URL":"https://example.com/sale","alias":"spring-sale"}`,
+		},
+		{
+			name: "should return 409 with result when alias already points to the same url",
+			want: want{
+				code:   http.StatusConflict,
+				result: "http://localhost:8080/spring-sale",
+			},
+			keysLinksUserID: map[string]util.MapValue{"spring-sale": {Link: "https://example.com/sale", UserID: "user1"}},
+			body:            `{"URL":"https://example.com/sale","alias":"spring-sale"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := memory.NewStorage(tt.keysLinksUserID, "", util.DedupGlobal)
+			var p postgres.Pinger
+			baseURL := "http://localhost:8080"
+
+			c := NewHandler(s, p, baseURL, nil, nil, nil)
+			request := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(tt.body))
+			request = request.WithContext(context.WithValue(request.Context(), "user_id", "user1"))
+
+			w := httptest.NewRecorder()
+			h := http.HandlerFunc(c.ShortenJSONLink)
+
+			h.ServeHTTP(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.want.code, res.StatusCode)
+
+			if tt.want.result != "" {
+				var resp Response
+				require.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+				assert.Equal(t, tt.want.result, resp.Result)
+			}
+
+			if tt.want.error != "" {
+				var resp ErrorResponse
+				require.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+				assert.Equal(t, tt.want.error, resp.Error)
+			}
+		})
+	}
+}
+
+func Test_ExpirationResolve(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	future := now.Add(time.Hour)
+	past := now.Add(-time.Hour)
+
+	tests := []struct {
+		name    string
+		e       Expiration
+		want    *time.Time
+		wantErr bool
+	}{
+		{name: "no expiry", e: Expiration{}},
+		{name: "ttl", e: Expiration{TTLSeconds: 3600}, want: &future},
+		{name: "absolute", e: Expiration{ExpiresAt: &future}, want: &future},
+		{name: "negative ttl", e: Expiration{TTLSeconds: -1}, wantErr: true},
+		{name: "absolute in the past", e: Expiration{ExpiresAt: &past}, wantErr: true},
+		{name: "absolute now", e: Expiration{ExpiresAt: &now}, wantErr: true},
+		{name: "both set", e: Expiration{ExpiresAt: &future, TTLSeconds: 60}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.e.Resolve(now)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_ShortenExpiration(t *testing.T) {
+	expired := time.Now().Add(-time.Minute)
+	newStorage := func() *memory.Storage {
+		s := memory.NewStorage(map[string]util.MapValue{
+			"old-sale": {Link: "https://example.com/old", UserID: "user2", ExpiresAt: &expired},
+		}, "", util.DedupGlobal)
+		require.NoError(t, s.AddClicks(context.Background(), []util.Click{{Key: "old-sale", ClickedAt: expired}}))
+		return s
+	}
+
+	tests := []struct {
+		name       string
+		target     string
+		body       string
+		wantStatus int
+		wantKey    string
+		wantTTL    bool
+	}{
+		{
+			name:       "ttl is stored",
+			target:     "/api/shorten",
+			body:       `{"URL":"https://go.dev","ttl_seconds":3600}`,
+			wantStatus: http.StatusCreated,
+			wantTTL:    true,
+		},
+		{
+			name:       "expires_at in the past is rejected",
+			target:     "/api/shorten",
+			body:       `{"URL":"https://go.dev","expires_at":"2020-01-01T00:00:00Z"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "expires_at together with ttl is rejected",
+			target:     "/api/shorten",
+			body:       `{"URL":"https://go.dev","expires_at":"2999-01-01T00:00:00Z","ttl_seconds":60}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "malformed expires_at is rejected",
+			target:     "/api/shorten",
+			body:       `{"URL":"https://go.dev","expires_at":"tomorrow"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "expired alias is free before the sweep",
+			target:     "/api/shorten",
+			body:       `{"URL":"https://example.com/new","alias":"old-sale"}`,
+			wantStatus: http.StatusCreated,
+			wantKey:    "old-sale",
+		},
+		{
+			name:       "url of an expired link gets a new key before the sweep",
+			target:     "/api/shorten",
+			body:       `{"URL":"https://example.com/old"}`,
+			wantStatus: http.StatusCreated,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStorage()
+			var p postgres.Pinger
+			c := NewHandler(s, p, "http://localhost:8080", nil, nil, nil)
+
+			request := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body))
+			request = request.WithContext(context.WithValue(request.Context(), "user_id", "user1"))
+
+			w := httptest.NewRecorder()
+			http.HandlerFunc(c.ShortenJSONLink).ServeHTTP(w, request)
+			require.Equal(t, tt.wantStatus, w.Code, w.Body.String())
+
+			if tt.wantStatus != http.StatusCreated {
+				return
+			}
+
+			var resp Response
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+
+			key := strings.TrimPrefix(resp.Result, "http://localhost:8080/")
+			if tt.wantKey != "" {
+				assert.Equal(t, tt.wantKey, key)
+
+				stats, err := s.GetClickStats(context.Background(), key)
+				require.NoError(t, err)
+				assert.Zero(t, stats.Total, "a reused key does not inherit the clicks of the expired link")
+			} else {
+				assert.NotEqual(t, "old-sale", key)
+			}
+
+			v, err := s.Get(context.Background(), key)
+			require.NoError(t, err)
+			assert.Equal(t, "user1", v.UserID)
+			if tt.wantTTL {
+				require.NotNil(t, v.ExpiresAt)
+				assert.WithinDuration(t, time.Now().Add(time.Hour), *v.ExpiresAt, time.Minute)
+			} else {
+				assert.Nil(t, v.ExpiresAt)
+			}
+		})
+	}
+}
+
+func Test_ShortenLinksInBatchExpiration(t *testing.T) {
+	expired := time.Now().Add(-time.Minute)
+	s := memory.NewStorage(map[string]util.MapValue{
+		"12345678": {Link: "https://example.com/old", UserID: "user1", ExpiresAt: &expired},
+	}, "", util.DedupGlobal)
+
+	var p postgres.Pinger
+	c := NewHandler(s, p, "http://localhost:8080", nil, nil, nil)
+
+	body := `[{"correlation_id":"1","original_url":"https://example.com/old","ttl_seconds":60},` +
+		`{"correlation_id":"2","original_url":"https://go.dev","expires_at":"2020-01-01T00:00:00Z"},` +
+		`{"correlation_id":"3","original_url":"https://go.dev/doc","expires_at":"2999-01-01T00:00:00Z","ttl_seconds":60}]`
+
+	request := httptest.NewRequest(http.MethodPost, "/api/shorten/batch", strings.NewReader(body))
+	request = request.WithContext(context.WithValue(request.Context(), "user_id", "user1"))
+
+	w := httptest.NewRecorder()
+	http.HandlerFunc(c.ShortenLinksInBatch).ServeHTTP(w, request)
+	require.Equal(t, http.StatusMultiStatus, w.Code)
+
+	var got []util.BatchResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+	require.Len(t, got, 3)
+
+	assert.Equal(t, util.BatchCreated, got[0].Status, "the url of an expired link is shortened again")
+	assert.NotEqual(t, "http://localhost:8080/12345678", got[0].ShortURL)
+	require.NotNil(t, got[0].ExpiresAt)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), *got[0].ExpiresAt, 10*time.Second)
+
+	for _, v := range got[1:] {
+		assert.Equal(t, util.BatchInvalid, v.Status)
+		assert.NotEmpty(t, v.Error)
+	}
+}
+
+func Test_GetURLStats(t *testing.T) {
+	day := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		userID     string
+		key        string
+		clicks     []util.Click
+		wantStatus int
+		wantStats  util.ClickStats
+	}{
+		{
+			name:   "should return totals, unique visitors and daily histogram",
+			userID: "user1",
+			key:    "12345678",
+			clicks: []util.Click{
+				{Key: "12345678", ClickedAt: day, UserAgent: "curl", IP: "10.0.0.0"},
+				{Key: "12345678", ClickedAt: day.Add(time.Hour), UserAgent: "curl", IP: "10.0.0.0"},
+				{Key: "12345678", ClickedAt: day.Add(24 * time.Hour), UserAgent: "firefox", IP: "10.0.1.0"},
+			},
+			wantStatus: http.StatusOK,
+			wantStats: util.ClickStats{
+				Total:          3,
+				UniqueVisitors: 2,
+				Daily: []util.DailyClicks{
+					{Date: "2023-10-01", Clicks: 2},
+					{Date: "2023-10-02", Clicks: 1},
+				},
+			},
+		},
+		{
+			name:       "should return 403 for a link of another user",
+			userID:     "user2",
+			key:        "12345678",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "should return 404 for unknown key",
+			userID:     "user1",
+			key:        "unknown",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := memory.NewStorage(map[string]util.MapValue{"12345678": {Link: "https://go.dev", UserID: "user1"}}, "", util.DedupGlobal)
+			require.NoError(t, s.AddClicks(context.Background(), tt.clicks))
+
+			var p postgres.Pinger
+			c := NewHandler(s, p, "http://localhost:8080", nil, nil, nil)
+
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("key", tt.key)
+
+			request := httptest.NewRequest(http.MethodGet, "/api/user/urls/"+tt.key+"/stats", nil)
+			ctx := context.WithValue(request.Context(), chi.RouteCtxKey, rctx)
+			request = request.WithContext(context.WithValue(ctx, "user_id", tt.userID))
+
+			w := httptest.NewRecorder()
+			http.HandlerFunc(c.GetURLStats).ServeHTTP(w, request)
+
+			res := w.Result()
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.wantStatus, res.StatusCode)
+
+			if tt.wantStatus == http.StatusOK {
+				var stats util.ClickStats
+				require.NoError(t, json.NewDecoder(res.Body).Decode(&stats))
+				assert.Equal(t, tt.wantStats, stats)
+			}
+		})
+	}
+}
+
+func Test_SweptKeysStartWithoutClicks(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Hour)
+
+	tests := []struct {
+		name  string
+		value util.MapValue
+		sweep func(*memory.Storage) (int64, error)
+	}{
+		{
+			name:  "purged",
+			value: util.MapValue{Link: "https://example.com", UserID: "user1", IsDeleted: true, DeletedAt: &past},
+			sweep: func(s *memory.Storage) (int64, error) { return s.PurgeDeleted(context.Background(), now) },
+		},
+		{
+			name:  "expired",
+			value: util.MapValue{Link: "https://example.com", UserID: "user1", ExpiresAt: &past},
+			sweep: func(s *memory.Storage) (int64, error) { return s.DeleteExpired(context.Background(), now) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := memory.NewStorage(map[string]util.MapValue{"spring-sale": tt.value}, "", util.DedupGlobal)
+			require.NoError(t, s.AddClicks(ctx, []util.Click{{Key: "spring-sale", ClickedAt: past}}))
+
+			removed, err := tt.sweep(s)
+			require.NoError(t, err)
+			assert.Equal(t, int64(1), removed)
+
+			require.NoError(t, s.AddClicks(ctx, []util.Click{{Key: "spring-sale", ClickedAt: now}}))
+			require.NoError(t, s.Add(ctx, "spring-sale", "https://example.org", "user2", nil))
+
+			stats, err := s.GetClickStats(ctx, "spring-sale")
+			require.NoError(t, err)
+			assert.Zero(t, stats.Total)
+		})
+	}
+}
+
+func Test_PurgeDeletedIsPersisted(t *testing.T) {
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "storage.json")
+
+	s := memory.NewStorage(map[string]util.MapValue{}, fileName, util.DedupGlobal)
+	require.NoError(t, s.Add(ctx, "purged01", "https://example.com/purged", "user1", nil))
+	require.NoError(t, s.Add(ctx, "deleted1", "https://example.com/deleted", "user1", nil))
+	require.NoError(t, s.Add(ctx, "kept0001", "https://example.com/kept", "user1", nil))
+
+	_, err := s.DeleteURLS(ctx, "user1", []string{"purged01"})
+	require.NoError(t, err)
+
+	purged, err := s.PurgeDeleted(ctx, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), purged)
+
+	_, err = s.DeleteURLS(ctx, "user1", []string{"deleted1"})
+	require.NoError(t, err)
+
+	reloaded := make(map[string]util.MapValue)
+	reader, err := file.SeedMapWithKeysAndLinks(fileName, reloaded)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+
+	assert.NotContains(t, reloaded, "purged01")
+	assert.True(t, reloaded["deleted1"].IsDeleted)
+	assert.Contains(t, reloaded, "kept0001")
+}
+
+func Test_GetInternalStats(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("192.168.1.0/24")
+	require.NoError(t, err)
+	_, proxies, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		trustedSubnet *net.IPNet
+		remoteAddr    string
+		realIP        string
+		wantStatus    int
+		wantStats     util.InternalStats
+	}{
+		{
+			name:          "should return stats for ip inside trusted subnet",
+			trustedSubnet: subnet,
+			remoteAddr:    "192.168.1.10:1234",
+			wantStatus:    http.StatusOK,
+			wantStats:     util.InternalStats{URLs: 3, Users: 2},
+		},
+		{
+			name:          "should return stats for ip inside trusted subnet behind a trusted proxy",
+			trustedSubnet: subnet,
+			remoteAddr:    "10.0.0.2:1234",
+			realIP:        "192.168.1.10",
+			wantStatus:    http.StatusOK,
+			wantStats:     util.InternalStats{URLs: 3, Users: 2},
+		},
+		{
+			name:          "should return 403 for ip outside trusted subnet",
+			trustedSubnet: subnet,
+			remoteAddr:    "10.0.0.2:1234",
+			realIP:        "10.0.0.1",
+			wantStatus:    http.StatusForbidden,
+		},
+		{
+			name:          "should return 403 for spoofed X-Real-IP from an untrusted peer",
+			trustedSubnet: subnet,
+			remoteAddr:    "203.0.113.5:1234",
+			realIP:        "192.168.1.10",
+			wantStatus:    http.StatusForbidden,
+		},
+		{
+			name:          "should return 403 without a client address",
+			trustedSubnet: subnet,
+			wantStatus:    http.StatusForbidden,
+		},
+		{
+			name:       "should return 403 when trusted subnet is not configured",
+			remoteAddr: "192.168.1.10:1234",
+			wantStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := memory.NewStorage(map[string]util.MapValue{
+				"key1": {Link: "https://example.com/1", UserID: "user1"},
+				"key2": {Link: "https://example.com/2", UserID: "user1"},
+				"key3": {Link: "https://example.com/3", UserID: "user2"},
+			}, "", util.DedupGlobal)
+			var p postgres.Pinger
+
+			key, err := encryption.GenerateKey()
+			require.NoError(t, err)
+
+			r, err := NewRouter(NewHandler(s, p, "", nil, nil, nil), encryption.NewEncryptor(key), tt.trustedSubnet, proxies, RateLimiters{})
+			require.NoError(t, err)
+
+			req, err := http.NewRequest(http.MethodGet, "/api/internal/stats", nil)
+			require.NoError(t, err)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			res := w.Result()
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.wantStatus, res.StatusCode)
+
+			if tt.wantStatus == http.StatusOK {
+				var stats util.InternalStats
+				require.NoError(t, json.NewDecoder(res.Body).Decode(&stats))
+				assert.Equal(t, tt.wantStats, stats)
+			}
+		})
+	}
+}
+
+type fakeWorker struct {
+	jobs map[string]util.DeleteJob
+}
+
+func (f *fakeWorker) Submit(userID string, keys []string) (util.DeleteJob, error) {
+	job := util.DeleteJob{ID: "job1", UserID: userID, Keys: keys, Status: util.JobQueued}
+	f.jobs[job.ID] = job
+	return job, nil
+}
+
+func (f *fakeWorker) GetJob(id string) (util.DeleteJob, bool) {
+	job, ok := f.jobs[id]
+	return job, ok
+}
+
+func Test_GetDeleteJob(t *testing.T) {
+	tests := []struct {
+		name       string
+		userID     string
+		id         string
+		wantStatus int
+	}{
+		{
+			name:       "should return the job of its owner",
+			userID:     "user1",
+			id:         "job1",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "should return 404 for a job of another user",
+			userID:     "user2",
+			id:         "job1",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "should return 404 for unknown job",
+			userID:     "user1",
+			id:         "unknown",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := memory.NewStorage(map[string]util.MapValue{}, "", util.DedupGlobal)
+			worker := &fakeWorker{jobs: make(map[string]util.DeleteJob)}
+
+			var p postgres.Pinger
+			c := NewHandler(s, p, "http://localhost:8080", worker, nil, nil)
+
+			request := httptest.NewRequest(http.MethodDelete, "/api/user/urls", strings.NewReader(`["a","b"]`))
+			request = request.WithContext(context.WithValue(request.Context(), "user_id", "user1"))
+			w := httptest.NewRecorder()
+			http.HandlerFunc(c.DeleteHandler).ServeHTTP(w, request)
+			require.Equal(t, http.StatusAccepted, w.Code)
+
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("id", tt.id)
+
+			request = httptest.NewRequest(http.MethodGet, "/api/user/jobs/"+tt.id, nil)
+			ctx := context.WithValue(request.Context(), chi.RouteCtxKey, rctx)
+			request = request.WithContext(context.WithValue(ctx, "user_id", tt.userID))
+
+			w = httptest.NewRecorder()
+			http.HandlerFunc(c.GetDeleteJob).ServeHTTP(w, request)
+
+			res := w.Result()
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.wantStatus, res.StatusCode)
+
+			if tt.wantStatus == http.StatusOK {
+				var job util.DeleteJob
+				require.NoError(t, json.NewDecoder(res.Body).Decode(&job))
+				assert.Equal(t, "job1", job.ID)
+				assert.Equal(t, util.JobQueued, job.Status)
+			}
+		})
+	}
+}
+
+func Test_RestoreHandler(t *testing.T) {
+	tests := []struct {
+		name         string
+		userID       string
+		body         string
+		wantStatus   int
+		wantRestored int64
+		wantDeleted  bool
+	}{
+		{
+			name:         "should restore a deleted link of the user",
+			userID:       "user1",
+			body:         `["12345678","unknown"]`,
+			wantStatus:   http.StatusOK,
+			wantRestored: 1,
+			wantDeleted:  false,
+		},
+		{
+			name:         "should not restore a link of another user",
+			userID:       "user2",
+			body:         `["12345678"]`,
+			wantStatus:   http.StatusOK,
+			wantRestored: 0,
+			wantDeleted:  true,
+		},
+		{
+			name:        "should return 400 for malformed body",
+			userID:      "user1",
+			body:        `12345678`,
+			wantStatus:  http.StatusBadRequest,
+			wantDeleted: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := memory.NewStorage(map[string]util.MapValue{"12345678": {Link: "https://go.dev", UserID: "user1"}}, "", util.DedupGlobal)
+			_, err := s.DeleteURLS(context.Background(), "user1", []string{"12345678"})
+			require.NoError(t, err)
+
+			var p postgres.Pinger
+			c := NewHandler(s, p, "http://localhost:8080", nil, nil, nil)
+
+			request := httptest.NewRequest(http.MethodPost, "/api/user/urls/restore", strings.NewReader(tt.body))
+			request = request.WithContext(context.WithValue(request.Context(), "user_id", tt.userID))
+
+			w := httptest.NewRecorder()
+			http.HandlerFunc(c.RestoreHandler).ServeHTTP(w, request)
+
+			res := w.Result()
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.wantStatus, res.StatusCode)
+
+			if tt.wantStatus == http.StatusOK {
+				var restore RestoreResponse
+				require.NoError(t, json.NewDecoder(res.Body).Decode(&restore))
+				assert.Equal(t, tt.wantRestored, restore.Restored)
+			}
+
+			v, err := s.Get(context.Background(), "12345678")
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantDeleted, v.IsDeleted)
+		})
+	}
+}
+
+func Test_UpdateURL(t *testing.T) {
+	tests := []struct {
+		name        string
+		userID      string
+		key         string
+		body        string
+		wantStatus  int
+		wantURL     string
+		wantHistory []string
+	}{
+		{
+			name:        "should change the destination and keep the previous one",
+			userID:      "user1",
+			key:         "12345678",
+			body:        `{"url":"https://go.dev/doc"}`,
+			wantStatus:  http.StatusOK,
+			wantURL:     "https://go.dev/doc",
+			wantHistory: []string{"https://go.dev"},
+		},
+		{
+			name:        "should not record a revision for the same destination",
+			userID:      "user1",
+			key:         "12345678",
+			body:        `{"url":"https://go.dev"}`,
+			wantStatus:  http.StatusOK,
+			wantURL:     "https://go.dev",
+			wantHistory: []string{},
+		},
+		{
+			name:        "should return 409 for a destination shortened under another key",
+			userID:      "user1",
+			key:         "12345678",
+			body:        `{"url":"https://pkg.go.dev"}`,
+			wantStatus:  http.StatusConflict,
+			wantURL:     "https://go.dev",
+			wantHistory: []string{},
+		},
+		{
+			name:        "should return 403 for a link of another user",
+			userID:      "user2",
+			key:         "12345678",
+			body:        `{"url":"https://go.dev/doc"}`,
+			wantStatus:  http.StatusForbidden,
+			wantURL:     "https://go.dev",
+			wantHistory: []string{},
+		},
+		{
+			name:       "should return 404 for unknown key",
+			userID:     "user1",
+			key:        "unknown",
+			body:       `{"url":"https://go.dev/doc"}`,
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := memory.NewStorage(map[string]util.MapValue{
+				"12345678": {Link: "https://go.dev", UserID: "user1"},
+				"87654321": {Link: "https://pkg.go.dev", UserID: "user1"},
+			}, "", util.DedupGlobal)
+
+			var p postgres.Pinger
+			c := NewHandler(s, p, "http://localhost:8080", nil, nil, nil)
+
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("key", tt.key)
+
+			request := httptest.NewRequest(http.MethodPatch, "/api/user/urls/"+tt.key, strings.NewReader(tt.body))
+			ctx := context.WithValue(request.Context(), chi.RouteCtxKey, rctx)
+			request = request.WithContext(context.WithValue(ctx, "user_id", tt.userID))
+
+			w := httptest.NewRecorder()
+			http.HandlerFunc(c.UpdateURL).ServeHTTP(w, request)
+
+			res := w.Result()
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.wantStatus, res.StatusCode)
+
+			if tt.wantURL == "" {
+				return
+			}
+
+			v, err := s.Get(context.Background(), tt.key)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantURL, v.OriginalURL)
+
+			request = httptest.NewRequest(http.MethodGet, "/api/user/urls/"+tt.key+"/history", nil)
+			ctx = context.WithValue(request.Context(), chi.RouteCtxKey, rctx)
+			request = request.WithContext(context.WithValue(ctx, "user_id", "user1"))
+
+			w = httptest.NewRecorder()
+			http.HandlerFunc(c.GetURLHistory).ServeHTTP(w, request)
+			require.Equal(t, http.StatusOK, w.Code)
+
+			var revisions []util.Revision
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&revisions))
+
+			history := []string{}
+			for _, r := range revisions {
+				history = append(history, r.OriginalURL)
+			}
+			assert.Equal(t, tt.wantHistory, history)
+		})
+	}
+}
+
+func Test_GetUrlsByUserID(t *testing.T) {
+	day := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	urls := map[string]util.MapValue{
+		"aaaaaaaa": {Link: "https://go.dev", UserID: "user1", CreatedAt: day},
+		"bbbbbbbb": {Link: "https://pkg.go.dev", UserID: "user1", CreatedAt: day.Add(time.Hour)},
+		"cccccccc": {Link: "https://example.com", UserID: "user1", CreatedAt: day.Add(2 * time.Hour), IsDeleted: true},
+		"dddddddd": {Link: "https://GO.dev/blog", UserID: "user1", CreatedAt: day.Add(2 * time.Hour)},
+		"eeeeeeee": {Link: "https://go.dev/doc", UserID: "user2", CreatedAt: day},
+	}
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantPages  [][]string
+	}{
+		{
+			name:       "should return every url of the user by default",
+			wantStatus: http.StatusOK,
+			wantPages:  [][]string{{"aaaaaaaa", "bbbbbbbb", "cccccccc", "dddddddd"}},
+		},
+		{
+			name:       "should page through the urls with a cursor",
+			query:      "limit=3",
+			wantStatus: http.StatusOK,
+			wantPages:  [][]string{{"aaaaaaaa", "bbbbbbbb", "cccccccc"}, {"dddddddd"}},
+		},
+		{
+			name:       "should sort from the newest",
+			query:      "limit=2&sort=-created_at",
+			wantStatus: http.StatusOK,
+			wantPages:  [][]string{{"dddddddd", "cccccccc"}, {"bbbbbbbb", "aaaaaaaa"}},
+		},
+		{
+			name:       "should filter by deleted state and search",
+			query:      "deleted=false&search=go.DEV",
+			wantStatus: http.StatusOK,
+			wantPages:  [][]string{{"aaaaaaaa", "bbbbbbbb", "dddddddd"}},
+		},
+		{
+			name:       "should return 400 for invalid limit",
+			query:      "limit=0",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "should return 400 for invalid cursor",
+			query:      "cursor=nope",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "should return 400 for unsupported sort",
+			query:      "sort=original_url",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := memory.NewStorage(urls, "", util.DedupGlobal)
+
+			var p postgres.Pinger
+			c := NewHandler(s, p, "http://localhost:8080", nil, nil, nil)
+
+			query := tt.query
+			for page := 0; ; page++ {
+				request := httptest.NewRequest(http.MethodGet, "/api/user/urls?"+query, nil)
+				request = request.WithContext(context.WithValue(request.Context(), "user_id", "user1"))
+
+				w := httptest.NewRecorder()
+				http.HandlerFunc(c.GetUrlsByUserID).ServeHTTP(w, request)
+
+				res := w.Result()
+				defer res.Body.Close()
+
+				require.Equal(t, tt.wantStatus, res.StatusCode)
+				if tt.wantStatus != http.StatusOK {
+					return
+				}
+
+				var got []util.AllURLSResponse
+				require.NoError(t, json.NewDecoder(res.Body).Decode(&got))
+
+				var keys []string
+				for _, v := range got {
+					keys = append(keys, strings.TrimPrefix(v.ShortURL, "http://localhost:8080/"))
+				}
+				require.Less(t, page, len(tt.wantPages))
+				assert.Equal(t, tt.wantPages[page], keys)
+
+				next := res.Header.Get("X-Next-Cursor")
+				if next == "" {
+					assert.Equal(t, len(tt.wantPages)-1, page)
+					return
+				}
+				query = tt.query + "&cursor=" + next
+			}
+		})
+	}
+}
+
+func Test_ShortenLinksInBatch(t *testing.T) {
+	type item struct {
+		status   string
+		shortURL string
+	}
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		want       []item
+	}{
+		{
+			name:       "all created",
+			body:       `[{"correlation_id":"1","original_url":"https://go.dev"},{"correlation_id":"2","original_url":"https://go.dev/doc"}]`,
+			wantStatus: http.StatusCreated,
+			want:       []item{{status: util.BatchCreated}, {status: util.BatchCreated}},
+		},
+		{
+			name:       "existing and invalid items do not fail the batch",
+			body:       `[{"correlation_id":"1","original_url":"https://example.com"},{"correlation_id":"2","original_url":""},{"correlation_id":"3","original_url":"https://go.dev","ttl_seconds":-1},{"correlation_id":"4","original_url":"https://go.dev/blog"}]`,
+			wantStatus: http.StatusMultiStatus,
+			want: []item{
+				{status: util.BatchExisting, shortURL: "http://localhost:8080/12345678"},
+				{status: util.BatchInvalid},
+				{status: util.BatchInvalid},
+				{status: util.BatchCreated},
+			},
+		},
+		{
+			name:       "duplicates within the batch",
+			body:       `[{"correlation_id":"1","original_url":"https://go.dev"},{"correlation_id":"2","original_url":"https://go.dev"}]`,
+			wantStatus: http.StatusMultiStatus,
+			want:       []item{{status: util.BatchCreated}, {status: util.BatchExisting}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := memory.NewStorage(map[string]util.MapValue{
+				"12345678": {Link: "https://example.com", UserID: "user2"},
+			}, "", util.DedupGlobal)
+
+			var p postgres.Pinger
+			c := NewHandler(s, p, "http://localhost:8080", nil, nil, nil)
+
+			request := httptest.NewRequest(http.MethodPost, "/api/shorten/batch", strings.NewReader(tt.body))
+			request = request.WithContext(context.WithValue(request.Context(), "user_id", "user1"))
+
+			w := httptest.NewRecorder()
+			http.HandlerFunc(c.ShortenLinksInBatch).ServeHTTP(w, request)
+			require.Equal(t, tt.wantStatus, w.Code)
+
+			var got []util.BatchResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+			require.Len(t, got, len(tt.want))
+
+			for i, want := range tt.want {
+				assert.Equal(t, fmt.Sprint(i+1), got[i].CorrelationID)
+				assert.Equal(t, want.status, got[i].Status)
+
+				switch want.status {
+				case util.BatchInvalid:
+					assert.Empty(t, got[i].ShortURL)
+					assert.NotEmpty(t, got[i].Error)
+				case util.BatchExisting:
+					if want.shortURL != "" {
+						assert.Equal(t, want.shortURL, got[i].ShortURL)
+					} else {
+						assert.Equal(t, got[0].ShortURL, got[i].ShortURL)
+					}
+				default:
+					assert.NotEmpty(t, got[i].ShortURL)
+				}
+			}
+		})
+	}
+}
+
+func Test_ShortenLinksStream(t *testing.T) {
+	var many strings.Builder
+	for i := 0; i < streamChunkSize*2+1; i++ {
+		fmt.Fprintf(&many, "{\"correlation_id\":\"%d\",\"original_url\":\"https://example.com/%d\"}\n", i, i)
+	}
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus []string
+	}{
+		{
+			name:       "mixed lines",
+			body:       "{\"correlation_id\":\"1\",\"original_url\":\"https://go.dev\"}\n\nnot json\n{\"correlation_id\":\"3\",\"original_url\":\"https://example.com\"}\n{\"correlation_id\":\"4\",\"original_url\":\"https://go.dev\"}",
+			wantStatus: []string{util.BatchCreated, util.BatchInvalid, util.BatchExisting, util.BatchExisting},
+		},
+		{
+			name: "several chunks",
+			body: many.String(),
+		},
+		{
+			name: "empty body",
+			body: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := memory.NewStorage(map[string]util.MapValue{
+				"12345678": {Link: "https://example.com", UserID: "user2"},
+			}, "", util.DedupGlobal)
+
+			var p postgres.Pinger
+			c := NewHandler(s, p, "http://localhost:8080", nil, nil, nil)
+
+			request := httptest.NewRequest(http.MethodPost, "/api/shorten/stream", strings.NewReader(tt.body))
+			request = request.WithContext(context.WithValue(request.Context(), "user_id", "user1"))
+
+			w := httptest.NewRecorder()
+			http.HandlerFunc(c.ShortenLinksStream).ServeHTTP(w, request)
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+
+			var got []util.BatchResponse
+			dec := json.NewDecoder(w.Body)
+			for dec.More() {
+				var v util.BatchResponse
+				require.NoError(t, dec.Decode(&v))
+				got = append(got, v)
+			}
+
+			lines := 0
+			for _, line := range strings.Split(tt.body, "\n") {
+				if strings.TrimSpace(line) != "" {
+					lines++
+				}
+			}
+			require.Len(t, got, lines)
+
+			for i, want := range tt.wantStatus {
+				assert.Equal(t, want, got[i].Status)
+			}
+			if tt.wantStatus == nil {
+				for i, v := range got {
+					assert.Equal(t, fmt.Sprint(i), v.CorrelationID)
+					assert.Equal(t, util.BatchCreated, v.Status)
+				}
+			}
+		})
+	}
+}
+
+func Test_ExportUserURLs(t *testing.T) {
+	created := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	expires := created.Add(24 * time.Hour)
+
+	tests := []struct {
+		name        string
+		query       string
+		wantStatus  int
+		contentType string
+		want        string
+	}{
+		{
+			name:        "ndjson by default",
+			wantStatus:  http.StatusOK,
+			contentType: "application/x-ndjson",
+			want: `{"short_url":"http://localhost:8080/first001","original_url":"https://go.dev","created_at":"2026-10-01T12:00:00Z","is_deleted":false,"expires_at":"2026-10-02T12:00:00Z","clicks":1,"correlation_id":"c1"}` + "\n" +
+				`{"short_url":"http://localhost:8080/second01","original_url":"https://go.dev/doc","created_at":"2026-10-01T13:00:00Z","is_deleted":true,"clicks":0}` + "\n",
+		},
+		{
+			name:        "csv",
+			query:       "?format=csv",
+			wantStatus:  http.StatusOK,
+			contentType: "text/csv",
+			want: "short_url,original_url,created_at,is_deleted,expires_at,clicks,correlation_id\n" +
+				"http://localhost:8080/first001,https://go.dev,2026-10-01T12:00:00Z,false,2026-10-02T12:00:00Z,1,c1\n" +
+				"http://localhost:8080/second01,https://go.dev/doc,2026-10-01T13:00:00Z,true,,0,\n",
+		},
+		{
+			name:       "unknown format",
+			query:      "?format=xml",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := memory.NewStorage(map[string]util.MapValue{
+				"second01": {Link: "https://go.dev/doc", UserID: "user1", CreatedAt: created.Add(time.Hour), IsDeleted: true},
+				"first001": {Link: "https://go.dev", UserID: "user1", CreatedAt: created, ExpiresAt: &expires, CorrelationID: "c1"},
+				"other001": {Link: "https://example.com", UserID: "user2", CreatedAt: created},
+			}, "", util.DedupGlobal)
+			require.NoError(t, s.AddClicks(context.Background(), []util.Click{{Key: "first001"}}))
+
+			var p postgres.Pinger
+			c := NewHandler(s, p, "http://localhost:8080", nil, nil, nil)
+
+			request := httptest.NewRequest(http.MethodGet, "/api/user/urls/export"+tt.query, nil)
+			request = request.WithContext(context.WithValue(request.Context(), "user_id", "user1"))
+
+			w := httptest.NewRecorder()
+			http.HandlerFunc(c.ExportUserURLs).ServeHTTP(w, request)
+
+			require.Equal(t, tt.wantStatus, w.Code)
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			assert.Equal(t, tt.contentType, w.Header().Get("Content-Type"))
+			assert.Contains(t, w.Header().Get("Content-Disposition"), "attachment")
+			assert.Equal(t, tt.want, w.Body.String())
+		})
+	}
+}
+
+func Test_ShortenLinkNormalization(t *testing.T) {
+	tests := []struct {
+		name       string
+		handler    func(c *Handler) http.HandlerFunc
+		body       string
+		wantStatus int
+		wantReason string
+		wantBody   string
+	}{
+		{
+			name:       "javascript url",
+			handler:    func(c *Handler) http.HandlerFunc { return c.ShortenLink },
+			body:       "javascript:alert(1)",
+			wantStatus: http.StatusBadRequest,
+			wantReason: normalize.ReasonSchemeNotAllowed,
+		},
+		{
+			name:       "relative path",
+			handler:    func(c *Handler) http.HandlerFunc { return c.ShortenLink },
+			body:       "/spring-sale",
+			wantStatus: http.StatusBadRequest,
+			wantReason: normalize.ReasonMissingScheme,
+		},
+		{
+			name:       "whitespace only",
+			handler:    func(c *Handler) http.HandlerFunc { return c.ShortenJSONLink },
+			body:       `{"URL":"  "}`,
+			wantStatus: http.StatusBadRequest,
+			wantReason: normalize.ReasonEmpty,
+		},
+		{
+			name:       "normalized url dedupes against the stored one",
+			handler:    func(c *Handler) http.HandlerFunc { return c.ShortenLink },
+			body:       " HTTPS://Example.COM:443/sale\n",
+			wantStatus: http.StatusConflict,
+			wantBody:   "http://localhost:8080/12345678",
+		},
+		{
+			name:       "normalized url dedupes in json",
+			handler:    func(c *Handler) http.HandlerFunc { return c.ShortenJSONLink },
+			body:       `{"URL":"https://EXAMPLE.com/sale"}`,
+			wantStatus: http.StatusConflict,
+			wantBody:   `{"result":"http://localhost:8080/12345678"}` + "\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := memory.NewStorage(map[string]util.MapValue{
+				"12345678": {Link: "https://example.com/sale", UserID: "user1"},
+			}, "", util.DedupGlobal)
+
+			var p postgres.Pinger
+			c := NewHandler(s, p, "http://localhost:8080", nil, nil, nil)
+
+			request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			request = request.WithContext(context.WithValue(request.Context(), "user_id", "user1"))
+
+			w := httptest.NewRecorder()
+			tt.handler(c).ServeHTTP(w, request)
+
+			require.Equal(t, tt.wantStatus, w.Code)
+			if tt.wantReason != "" {
+				var res ErrorResponse
+				require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+				assert.Equal(t, tt.wantReason, res.Reason)
+				return
+			}
+
+			assert.Equal(t, tt.wantBody, w.Body.String())
+		})
+	}
+}
+
+func Test_Screening(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist")
+	require.NoError(t, os.WriteFile(path, []byte("block suffix evil.example\n"), 0o600))
+
+	screener, err := screening.NewScreener(path, "http://localhost:8080")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		body       string
+		wantStatus int
+		wantReason string
+	}{
+		{
+			name:       "blocked destination",
+			method:     http.MethodPost,
+			target:     "/",
+			body:       "https://login.evil.example",
+			wantStatus: http.StatusBadRequest,
+			wantReason: screening.ReasonBlocked,
+		},
+		{
+			name:       "redirect loop",
+			method:     http.MethodPost,
+			target:     "/api/shorten",
+			body:       `{"URL":"http://localhost:8080/12345678"}`,
+			wantStatus: http.StatusBadRequest,
+			wantReason: screening.ReasonSelfReference,
+		},
+		{
+			name:       "allowed destination",
+			method:     http.MethodPost,
+			target:     "/",
+			body:       "https://go.dev",
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "existing link blocked later",
+			method:     http.MethodGet,
+			target:     "/blocked1",
+			wantStatus: http.StatusUnavailableForLegalReasons,
+		},
+		{
+			name:       "existing link not blocked",
+			method:     http.MethodGet,
+			target:     "/12345678",
+			wantStatus: http.StatusTemporaryRedirect,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := memory.NewStorage(map[string]util.MapValue{
+				"12345678": {Link: "https://example.com", UserID: "user1"},
+				"blocked1": {Link: "https://www.evil.example/login", UserID: "user1"},
+			}, "", util.DedupGlobal)
+
+			var p postgres.Pinger
+			c := NewHandler(s, p, "http://localhost:8080", nil, nil, screener)
+
+			r := chi.NewRouter()
+			r.Post("/", c.ShortenLink)
+			r.Post("/api/shorten", c.ShortenJSONLink)
+			r.Get("/{key}", c.GetURLLink)
+
+			request := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			request = request.WithContext(context.WithValue(request.Context(), "user_id", "user1"))
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, request)
+
+			require.Equal(t, tt.wantStatus, w.Code)
+			if tt.wantReason != "" {
+				var res ErrorResponse
+				require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+				assert.Equal(t, tt.wantReason, res.Reason)
+			}
+		})
+	}
+}
+
+func Test_APIKeys(t *testing.T) {
+	s := memory.NewStorage(map[string]util.MapValue{
+		"12345678": {Link: "https://example.com", UserID: "user1"},
+	}, "", util.DedupGlobal)
+
+	var p postgres.Pinger
+	c := NewHandler(s, p, "http://localhost:8080", nil, nil, nil)
+
+	encKey, err := encryption.GenerateKey()
+	require.NoError(t, err)
+	encryptor := encryption.NewEncryptor(encKey)
+
+	r, err := NewRouter(c, encryptor, nil, nil, RateLimiters{})
+	require.NoError(t, err)
+
+	cookie, err := encryptor.Encode([]byte("user1"))
+	require.NoError(t, err)
+
+	send := func(method, target, body string, auth func(*http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		auth(req)
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	withCookie := func(req *http.Request) {
+		req.AddCookie(&http.Cookie{Name: "user_id", Value: cookie})
+	}
+
+	w := send(http.MethodPost, "/api/user/keys", `{"name":"ci"}`, withCookie)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	var created APIKeyResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+	assert.Equal(t, "ci", created.Name)
+	assert.True(t, strings.HasPrefix(created.Key, "gs_"))
+	assert.True(t, strings.HasPrefix(created.Key, created.Prefix))
+
+	withKey := func(key string) func(*http.Request) {
+		return func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+	}
+
+	w = send(http.MethodGet, "/api/user/urls", "", withKey(created.Key))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Result().Cookies(), "requests with an api key get no cookie")
+
+	var urls []util.AllURLSResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&urls))
+	require.Len(t, urls, 1)
+	assert.Equal(t, "http://localhost:8080/12345678", urls[0].ShortURL)
+
+	w = send(http.MethodGet, "/api/user/keys", "", withCookie)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), created.Key)
+
+	var keys []util.APIKey
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&keys))
+	require.Len(t, keys, 1)
+	assert.Equal(t, created.ID, keys[0].ID)
+	assert.Nil(t, keys[0].RevokedAt)
+
+	w = send(http.MethodDelete, "/api/user/keys/"+created.ID, "", withKey("gs_unknown"))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = send(http.MethodDelete, "/api/user/keys/"+created.ID, "", func(*http.Request) {})
+	require.Equal(t, http.StatusNotFound, w.Code, "other users cannot revoke the key")
+
+	w = send(http.MethodDelete, "/api/user/keys/"+created.ID, "", withKey(created.Key))
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	w = send(http.MethodGet, "/api/user/urls", "", withKey(created.Key))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func Test_Accounts(t *testing.T) {
+	dir := t.TempDir()
+	s := memory.NewStorage(map[string]util.MapValue{
+		"12345678": {Link: "https://example.com", UserID: "anon1"},
+		"abcdefgh": {Link: "https://example.org", UserID: "anon2"},
+	}, filepath.Join(dir, "storage.json"), util.DedupGlobal)
+
+	var p postgres.Pinger
+	c := NewHandler(s, p, "http://localhost:8080", nil, nil, nil)
+
+	encKey, err := encryption.GenerateKey()
+	require.NoError(t, err)
+	encryptor := encryption.NewEncryptor(encKey)
+
+	r, err := NewRouter(c, encryptor, nil, nil, RateLimiters{})
+	require.NoError(t, err)
+
+	send := func(target, userID, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		if userID != "" {
+			cookie, err := encryptor.Encode([]byte(userID))
+			require.NoError(t, err)
+			req.AddCookie(&http.Cookie{Name: "user_id", Value: cookie})
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	decode := func(w *httptest.ResponseRecorder) (AccountResponse, string) {
+		var res AccountResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+
+		cookies := w.Result().Cookies()
+		require.NotEmpty(t, cookies)
+		cookie := cookies[len(cookies)-1]
+		assert.Equal(t, res.Token, cookie.Value)
+		assert.True(t, cookie.HttpOnly)
+		assert.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+		assert.Equal(t, "/", cookie.Path)
+
+		userID, err := encryptor.Decode(res.Token)
+		require.NoError(t, err)
+		return res, userID
+	}
+	links := func(userID string) []string {
+		res, _, err := s.GetAllLinksByUserID(context.Background(), userID, "", util.ListOptions{})
+		require.NoError(t, err)
+
+		var keys []string
+		for _, v := range res {
+			keys = append(keys, strings.TrimPrefix(v.ShortURL, "/"))
+		}
+		return keys
+	}
+
+	for _, body := range []string{
+		`{"username":"a","password":"password1"}`,
+		`{"username":"alice smith","password":"password1"}`,
+		`{"username":"alice","password":"short"}`,
+	} {
+		w := send("/api/user/register", "anon1", body)
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+
+	w := send("/api/user/register", "anon1", `{"username":" Alice ","password":"password1"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	registered, accountUserID := decode(w)
+	assert.Equal(t, "alice", registered.Username)
+	assert.Equal(t, int64(1), registered.Claimed)
+	assert.Equal(t, []string{"12345678"}, links(accountUserID))
+	assert.Empty(t, links("anon1"))
+
+	w = send("/api/user/register", "anon2", `{"username":"alice","password":"password2"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	for _, body := range []string{
+		`{"username":"alice","password":"password2"}`,
+		`{"username":"bob","password":"password1"}`,
+	} {
+		w = send("/api/user/login", "anon2", body)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, body)
+	}
+
+	form := httptest.NewRequest(http.MethodPost, "/api/user/login", strings.NewReader(`{"username":"alice","password":"password1"}`))
+	form.Header.Set("Content-Type", "text/plain")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, form)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code, "requests that a cross-site form can send are rejected")
+
+	w = send("/api/user/login", "anon2", `{"username":"ALICE","password":"password1"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	loggedIn, userID := decode(w)
+	assert.Equal(t, accountUserID, userID)
+	assert.Equal(t, int64(1), loggedIn.Claimed)
+	assert.ElementsMatch(t, []string{"12345678", "abcdefgh"}, links(accountUserID))
+
+	w = send("/api/user/register", accountUserID, `{"username":"bob","password":"password1"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	bob, _ := decode(w)
+	assert.Zero(t, bob.Claimed, "the links of an account cannot be claimed by another one")
+	assert.Len(t, links(accountUserID), 2)
+
+	reloaded := memory.NewStorage(nil, filepath.Join(dir, "storage.json"), util.DedupGlobal)
+	require.NoError(t, reloaded.LoadAccounts())
+	account, err := reloaded.GetAccount(context.Background(), "alice")
+	require.NoError(t, err)
+	assert.Equal(t, accountUserID, account.UserID)
+}
+
+func Test_GetUrlsByUserIDMetadata(t *testing.T) {
+	s := memory.NewStorage(map[string]util.MapValue{}, "", util.DedupGlobal)
+
+	var p postgres.Pinger
+	c := NewHandler(s, p, "http://localhost:8080", nil, nil, nil)
+
+	body := `[{"correlation_id":"first","original_url":"https://go.dev","ttl_seconds":3600}]`
+	request := httptest.NewRequest(http.MethodPost, "/api/shorten/batch", strings.NewReader(body))
+	request = request.WithContext(context.WithValue(request.Context(), "user_id", "user1"))
+
+	w := httptest.NewRecorder()
+	http.HandlerFunc(c.ShortenLinksInBatch).ServeHTTP(w, request)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	var batch []util.BatchResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&batch))
+	require.Len(t, batch, 1)
+
+	key := strings.TrimPrefix(batch[0].ShortURL, "http://localhost:8080/")
+	require.NoError(t, s.AddClicks(context.Background(), []util.Click{{Key: key}, {Key: key}}))
+
+	request = httptest.NewRequest(http.MethodGet, "/api/user/urls", nil)
+	request = request.WithContext(context.WithValue(request.Context(), "user_id", "user1"))
+
+	w = httptest.NewRecorder()
+	http.HandlerFunc(c.GetUrlsByUserID).ServeHTTP(w, request)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var got []util.AllURLSResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+	require.Len(t, got, 1)
+
+	assert.Equal(t, "first", got[0].CorrelationID)
+	assert.Equal(t, int64(2), got[0].Clicks)
+	assert.False(t, got[0].IsDeleted)
+	assert.False(t, got[0].CreatedAt.IsZero())
+	require.NotNil(t, got[0].ExpiresAt)
+	assert.WithinDuration(t, got[0].CreatedAt.Add(time.Hour), *got[0].ExpiresAt, time.Minute)
+}
+
+func Test_ShortenJSONLinkDedupMode(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       string
+		userID     string
+		wantStatus int
+		wantResult string
+	}{
+		{
+			name:       "global mode should return the key of another user",
+			mode:       util.DedupGlobal,
+			userID:     "user2",
+			wantStatus: http.StatusConflict,
+			wantResult: "http://localhost:8080/12345678",
+		},
+		{
+			name:       "per-user mode should create a key for another user",
+			mode:       util.DedupPerUser,
+			userID:     "user2",
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "per-user mode should return the key of the same user",
+			mode:       util.DedupPerUser,
+			userID:     "user1",
+			wantStatus: http.StatusConflict,
+			wantResult: "http://localhost:8080/12345678",
+		},
+		{
+			name:       "none mode should create a key for the same user",
+			mode:       util.DedupNone,
+			userID:     "user1",
+			wantStatus: http.StatusCreated,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := memory.NewStorage(map[string]util.MapValue{"12345678": {Link: "https://go.dev", UserID: "user1"}}, "", tt.mode)
+
+			var p postgres.Pinger
+			c := NewHandler(s, p, "http://localhost:8080", nil, nil, nil)
+
+			request := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url":"https://go.dev"}`))
+			request = request.WithContext(context.WithValue(request.Context(), "user_id", tt.userID))
+
+			w := httptest.NewRecorder()
+			http.HandlerFunc(c.ShortenJSONLink).ServeHTTP(w, request)
+
+			res := w.Result()
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.wantStatus, res.StatusCode)
+
+			var got Response
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&got))
+			if tt.wantResult != "" {
+				assert.Equal(t, tt.wantResult, got.Result)
+			} else {
+				assert.NotEqual(t, "http://localhost:8080/12345678", got.Result)
+			}
+		})
+	}
+}
+
+func Test_errorStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "not found", err: fmt.Errorf("%w: value abc", storage.ErrNotFound), want: http.StatusNotFound},
+		{name: "key taken", err: storage.ErrKeyTaken, want: http.StatusConflict},
+		{name: "duplicate url", err: fmt.Errorf("%w: unique violation", storage.ErrDuplicateURL), want: http.StatusConflict},
+		{name: "gone", err: storage.ErrGone, want: http.StatusGone},
+		{name: "forbidden", err: storage.ErrForbidden, want: http.StatusForbidden},
+		{name: "unknown", err: errors.New("connection refused"), want: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, errorStatus(tt.err))
+		})
+	}
+}
@@ -0,0 +1,19 @@
+// Package logger builds the structured logger shared by the whole application.
+package logger
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// New returns a logger that writes JSON lines to w, dropping records below level.
+// level is one of "debug", "info", "warn" or "error".
+func New(w io.Writer, level string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %w", level, err)
+	}
+
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: l})), nil
+}
@@ -0,0 +1,85 @@
+// Package metrics defines the Prometheus metrics of the URL shortener and the handler that exposes them.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "shortener"
+
+// Registry holds every metric of the application.
+var Registry = prometheus.NewRegistry()
+
+var (
+	// HTTPRequests counts the HTTP requests by method, route pattern and status code.
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "status"})
+
+	// HTTPRequestDuration observes the HTTP request latency by method and route pattern.
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by method and route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	// Redirects counts the lookups of short keys by result: hit, miss, gone or blocked.
+	Redirects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "redirects_total",
+		Help:      "Number of short key lookups by result.",
+	}, []string{"result"})
+
+	// JobFailures counts the background jobs that returned an error, by job name.
+	JobFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "workerpool_job_failures_total",
+		Help:      "Number of failed worker pool jobs by job name.",
+	}, []string{"job"})
+)
+
+// Redirect results used as the label of Redirects.
+const (
+	RedirectHit     = "hit"
+	RedirectMiss    = "miss"
+	RedirectGone    = "gone"
+	RedirectBlocked = "blocked"
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests,
+		HTTPRequestDuration,
+		Redirects,
+		JobFailures,
+	)
+}
+
+// Handler returns the HTTP handler that serves Registry in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// RegisterQueueDepth registers a gauge that reports the number of jobs waiting in the worker pool.
+func RegisterQueueDepth(depth func() float64) {
+	Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "workerpool_queue_depth",
+		Help:      "Number of jobs waiting in the worker pool queue.",
+	}, depth))
+}
+
+// RegisterPgxPool registers the statistics of the database connection pool.
+func RegisterPgxPool(pool *pgxpool.Pool) {
+	Registry.MustRegister(newPgxPoolCollector(pool))
+}
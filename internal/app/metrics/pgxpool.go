@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pgxPoolCollector exports pgxpool.Stat as Prometheus metrics on every scrape.
+type pgxPoolCollector struct {
+	pool *pgxpool.Pool
+
+	acquireCount         *prometheus.Desc
+	acquireDuration      *prometheus.Desc
+	acquiredConns        *prometheus.Desc
+	canceledAcquireCount *prometheus.Desc
+	constructingConns    *prometheus.Desc
+	emptyAcquireCount    *prometheus.Desc
+	idleConns            *prometheus.Desc
+	maxConns             *prometheus.Desc
+	totalConns           *prometheus.Desc
+}
+
+func newPgxPoolCollector(pool *pgxpool.Pool) *pgxPoolCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "pgxpool", name), help, nil, nil)
+	}
+
+	return &pgxPoolCollector{
+		pool:                 pool,
+		acquireCount:         desc("acquire_count_total", "Number of successful connection acquisitions."),
+		acquireDuration:      desc("acquire_duration_seconds_total", "Total time spent acquiring connections."),
+		acquiredConns:        desc("acquired_conns", "Number of currently acquired connections."),
+		canceledAcquireCount: desc("canceled_acquire_count_total", "Number of acquisitions canceled by a context."),
+		constructingConns:    desc("constructing_conns", "Number of connections being established."),
+		emptyAcquireCount:    desc("empty_acquire_count_total", "Number of acquisitions that had to wait for a connection."),
+		idleConns:            desc("idle_conns", "Number of idle connections."),
+		maxConns:             desc("max_conns", "Maximum size of the pool."),
+		totalConns:           desc("total_conns", "Total number of connections in the pool."),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *pgxPoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.acquireCount
+	ch <- c.acquireDuration
+	ch <- c.acquiredConns
+	ch <- c.canceledAcquireCount
+	ch <- c.constructingConns
+	ch <- c.emptyAcquireCount
+	ch <- c.idleConns
+	ch <- c.maxConns
+	ch <- c.totalConns
+}
+
+// Collect implements prometheus.Collector.
+func (c *pgxPoolCollector) Collect(ch chan<- prometheus.Metric) {
+	stat := c.pool.Stat()
+
+	ch <- prometheus.MustNewConstMetric(c.acquireCount, prometheus.CounterValue, float64(stat.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.acquireDuration, prometheus.CounterValue, stat.AcquireDuration().Seconds())
+	ch <- prometheus.MustNewConstMetric(c.acquiredConns, prometheus.GaugeValue, float64(stat.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(c.canceledAcquireCount, prometheus.CounterValue, float64(stat.CanceledAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.constructingConns, prometheus.GaugeValue, float64(stat.ConstructingConns()))
+	ch <- prometheus.MustNewConstMetric(c.emptyAcquireCount, prometheus.CounterValue, float64(stat.EmptyAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.idleConns, prometheus.GaugeValue, float64(stat.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(c.maxConns, prometheus.GaugeValue, float64(stat.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(c.totalConns, prometheus.GaugeValue, float64(stat.TotalConns()))
+}
@@ -15,11 +15,30 @@ const cookieName = "user_id"
 // ctxName is the key under which user ID will be stored in the context.
 var ctxName interface{} = "user_id"
 
+// ctxNewUser is the key under which the context records that the user ID was just generated.
+var ctxNewUser interface{} = "user_is_new"
+
+// IsNewUser reports whether CookieMiddleware generated the user ID of the request because
+// the request had no valid cookie.
+func IsNewUser(ctx context.Context) bool {
+	isNew, _ := ctx.Value(ctxNewUser).(bool)
+	return isNew
+}
+
 // CookieMiddleware is a middleware that ensures that each request has a user ID associated with it.
 // If an incoming request has a "user_id" cookie, it decodes its value and adds it to the request's context.
 // If the cookie is missing or cannot be decoded, a new user ID is generated, encoded, and set as a cookie
-// before adding it to the request's context. The middleware uses the provided encryption key for encoding
-// and decoding user IDs.
+// before adding it to the request's context. The middleware uses the provided codec, an
+// encryption.Encryptor or an encryption.JWT, for encoding and decoding user IDs. A token that the codec
+// asks to reissue, because it was encoded with a previous key or is about to expire, is set again as
+// a fresh cookie.
+//
+// The token can also be sent in the "Authorization: Bearer" header instead of the cookie. A bearer
+// token that cannot be decoded is rejected with 401 Unauthorized, because a client that manages its
+// token explicitly would not notice being given a new anonymous user.
+//
+// Requests that already carry a user ID in the context, such as the ones authenticated by
+// APIKeyAuth, are passed on without a cookie.
 //
 // The middleware relies on the encryption and util packages to handle the encoding/decoding
 // and user ID generation respectively.
@@ -27,23 +46,45 @@ var ctxName interface{} = "user_id"
 // Usage:
 //
 //	r := chi.NewRouter()
-//	r.Use(middleware.CookieMiddleware(yourEncryptionKey))
+//	r.Use(middleware.CookieMiddleware(encryption.NewEncryptor(key, previousKeys...)))
 //	...
 //
 //	// Inside your handler:
 //	userID := r.Context().Value("user_id").(string)
-func CookieMiddleware(key []byte) func(next http.Handler) http.Handler {
+func CookieMiddleware(codec encryption.Codec) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			cookieUserID, _ := r.Cookie(cookieName)
-			encryptor := encryption.NewEncryptor(key)
+			if userID, _ := r.Context().Value(ctxName).(string); userID != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			bearer := BearerToken(r)
+			token := bearer
+			if token == "" {
+				if cookieUserID, _ := r.Cookie(cookieName); cookieUserID != nil {
+					token = cookieUserID.Value
+				}
+			}
 
-			if cookieUserID != nil {
-				userID, err := encryptor.Decode(cookieUserID.Value)
+			if token != "" {
+				userID, reissue, err := codec.DecodeWithRotation(token)
 
 				if err == nil {
-					ctx := context.WithValue(r.Context(), ctxName, userID)
-					next.ServeHTTP(w, r.WithContext(ctx))
+					if reissue {
+						if _, err := SetUserIDCookie(w, codec, userID); err != nil {
+							http.Error(w, err.Error(), http.StatusInternalServerError)
+							return
+						}
+					}
+
+					next.ServeHTTP(w, r.WithContext(withUserID(r, userID)))
+					return
+				}
+
+				if bearer != "" {
+					w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+					http.Error(w, "invalid token", http.StatusUnauthorized)
 					return
 				}
 			}
@@ -54,17 +95,32 @@ func CookieMiddleware(key []byte) func(next http.Handler) http.Handler {
 				return
 			}
 
-			encoded, err := encryptor.Encode([]byte(userID))
-			if err != nil {
+			if _, err := SetUserIDCookie(w, codec, userID); err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 
-			cookie := &http.Cookie{Name: "user_id", Value: encoded}
-			http.SetCookie(w, cookie)
-
-			ctx := context.WithValue(r.Context(), ctxName, userID)
+			ctx := context.WithValue(withUserID(r, userID), ctxNewUser, true)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
+
+// SetUserIDCookie encodes userID with the current key of codec, sets it as the "user_id" cookie
+// and returns the encoded value. The cookie is valid for the whole site, hidden from scripts and
+// not sent with cross-site subrequests and form posts.
+func SetUserIDCookie(w http.ResponseWriter, codec encryption.Codec, userID string) (string, error) {
+	encoded, err := codec.Encode([]byte(userID))
+	if err != nil {
+		return "", err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieName,
+		Value:    encoded,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return encoded, nil
+}
@@ -0,0 +1,105 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/trunov/go-shortener/internal/app/encryption"
+)
+
+func Test_CookieMiddlewareJWT(t *testing.T) {
+	secret, err := encryption.GenerateKey()
+	require.NoError(t, err)
+	codec, err := encryption.NewHS256(secret, time.Hour, 10*time.Minute)
+	require.NoError(t, err)
+
+	token, err := codec.Encode([]byte("user1"))
+	require.NoError(t, err)
+
+	shortLived, err := encryption.NewHS256(secret, 5*time.Minute, 0)
+	require.NoError(t, err)
+	expiring, err := shortLived.Encode([]byte("user1"))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		cookie     string
+		bearer     string
+		wantStatus int
+		wantUserID string
+		wantCookie bool
+	}{
+		{
+			name:       "token from the cookie",
+			cookie:     token,
+			wantStatus: http.StatusOK,
+			wantUserID: "user1",
+		},
+		{
+			name:       "token from the authorization header",
+			bearer:     token,
+			wantStatus: http.StatusOK,
+			wantUserID: "user1",
+		},
+		{
+			name:       "token close to expiry is reissued",
+			cookie:     expiring,
+			wantStatus: http.StatusOK,
+			wantUserID: "user1",
+			wantCookie: true,
+		},
+		{
+			name:       "invalid cookie gets a new user",
+			cookie:     "invalid",
+			wantStatus: http.StatusOK,
+			wantCookie: true,
+		},
+		{
+			name:       "invalid bearer token is rejected",
+			bearer:     "invalid",
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotUserID string
+			h := CookieMiddleware(codec)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotUserID = r.Context().Value(ctxName).(string)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: cookieName, Value: tt.cookie})
+			}
+			if tt.bearer != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			require.Equal(t, tt.wantStatus, w.Code)
+			if tt.wantUserID != "" {
+				assert.Equal(t, tt.wantUserID, gotUserID)
+			}
+
+			cookies := w.Result().Cookies()
+			if !tt.wantCookie {
+				assert.Empty(t, cookies)
+				return
+			}
+
+			require.Len(t, cookies, 1)
+			userID, reissue, err := codec.DecodeWithRotation(cookies[0].Value)
+			require.NoError(t, err)
+			assert.False(t, reissue)
+			assert.Equal(t, gotUserID, userID)
+		})
+	}
+}
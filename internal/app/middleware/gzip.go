@@ -19,6 +19,22 @@ func (w gzipWriter) Write(b []byte) (int, error) {
 	return w.Writer.Write(b)
 }
 
+// Flush writes the compressed data buffered so far and sends it to the client,
+// so streamed responses are not held back until the handler returns.
+func (w gzipWriter) Flush() {
+	if f, ok := w.Writer.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying http.ResponseWriter for http.ResponseController.
+func (w gzipWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 // GzipHandle is a middleware that compresses the HTTP response using GZIP compression
 // if the client's "Accept-Encoding" header includes "gzip". The compressed response
 // will include a "Content-Encoding: gzip" header.
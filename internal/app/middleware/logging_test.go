@@ -0,0 +1,127 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	chiMiddleware "github.com/go-chi/chi/v5/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/trunov/go-shortener/internal/app/apikey"
+	"github.com/trunov/go-shortener/internal/app/encryption"
+	"github.com/trunov/go-shortener/internal/app/storage"
+)
+
+func Test_RequestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("http://localhost:8080/12345678"))
+	})
+
+	h := chiMiddleware.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), ctxName, "user1")
+		RequestLogger(logger)(next).ServeHTTP(w, r.WithContext(ctx))
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	var line map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+
+	assert.Equal(t, "INFO", line["level"])
+	assert.Equal(t, http.MethodPost, line["method"])
+	assert.Equal(t, "/", line["path"])
+	assert.Equal(t, float64(http.StatusCreated), line["status"])
+	assert.Equal(t, float64(len("http://localhost:8080/12345678")), line["size"])
+	assert.Equal(t, "user1", line["user_id"])
+	assert.NotEmpty(t, line["request_id"])
+	assert.Contains(t, line, "duration")
+}
+
+// apiKeyStore is an APIKeyStore that knows the keys in the map, by hash.
+type apiKeyStore map[string]string
+
+func (s apiKeyStore) GetUserIDByAPIKey(_ context.Context, hash string) (string, error) {
+	userID, ok := s[hash]
+	if !ok {
+		return "", storage.ErrNotFound
+	}
+	return userID, nil
+}
+
+func Test_RequestLoggerBeforeAPIKeyAuth(t *testing.T) {
+	key, err := apikey.Generate()
+	require.NoError(t, err)
+	hash := apikey.Hash(key)
+
+	tests := []struct {
+		name       string
+		key        string
+		wantStatus int
+		wantUserID string
+	}{
+		{
+			name:       "user of a valid key is logged",
+			key:        key,
+			wantStatus: http.StatusOK,
+			wantUserID: "user1",
+		},
+		{
+			name:       "rejected key is logged",
+			key:        apikey.Prefix + "unknown",
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			h := RequestLogger(logger)(APIKeyAuth(apiKeyStore{hash: "user1"})(next))
+
+			req := httptest.NewRequest(http.MethodGet, "/api/user/urls", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.key)
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			var line map[string]interface{}
+			require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+
+			assert.Equal(t, float64(tt.wantStatus), line["status"])
+			assert.Equal(t, tt.wantUserID, line["user_id"])
+		})
+	}
+}
+
+func Test_RequestLoggerBeforeCookieMiddleware(t *testing.T) {
+	secret, err := encryption.GenerateKey()
+	require.NoError(t, err)
+	codec, err := encryption.NewHS256(secret, time.Hour, 0)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := RequestLogger(logger)(CookieMiddleware(codec)(next))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/user/urls", nil)
+	req.Header.Set("Authorization", "Bearer invalid")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	var line map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, float64(http.StatusUnauthorized), line["status"], "rejected bearer token is logged")
+}
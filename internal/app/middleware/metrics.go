@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/trunov/go-shortener/internal/app/metrics"
+)
+
+// Metrics is a middleware that counts every request and observes its latency, labelled with
+// the method, the chi route pattern (for example "/{key}") and the status code. Requests that
+// do not match any route are labelled with the route "unmatched".
+//
+// Usage:
+//
+//	r := chi.NewRouter()
+//	r.Use(middleware.Metrics)
+//	...
+func Metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		lw := &statusWriter{ResponseWriter: w}
+
+		next.ServeHTTP(lw, r)
+
+		if lw.status == 0 {
+			lw.status = http.StatusOK
+		}
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+
+		metrics.HTTPRequests.WithLabelValues(r.Method, route, strconv.Itoa(lw.status)).Inc()
+		metrics.HTTPRequestDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
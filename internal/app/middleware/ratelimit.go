@@ -0,0 +1,186 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trunov/go-shortener/internal/app/util"
+)
+
+// Limiter decides whether one more request may be made under key. When it may not, Allow
+// returns how long to wait before retrying. Implementations must be safe for concurrent use;
+// MemoryLimiter keeps its state in the process, a shared store can implement the same interface.
+type Limiter interface {
+	Allow(ctx context.Context, key string) (bool, time.Duration, error)
+}
+
+// Rate is a token bucket that holds up to Requests tokens and refills them evenly over Per.
+type Rate struct {
+	Requests int
+	Per      time.Duration
+}
+
+// ParseRate parses a rate in the form "<requests>/<duration>", such as "60/1m" or "5/1s".
+// An empty string returns the zero Rate, which means no limit.
+func ParseRate(s string) (Rate, error) {
+	if s == "" {
+		return Rate{}, nil
+	}
+
+	requests, per, ok := strings.Cut(s, "/")
+	if !ok {
+		return Rate{}, fmt.Errorf("rate %q must be in the form <requests>/<duration>", s)
+	}
+
+	n, err := strconv.Atoi(requests)
+	if err != nil || n <= 0 {
+		return Rate{}, fmt.Errorf("rate %q must allow a positive number of requests", s)
+	}
+
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return Rate{}, fmt.Errorf("rate %q must have a positive duration", s)
+	}
+
+	return Rate{Requests: n, Per: d}, nil
+}
+
+// IsZero reports whether the rate sets no limit.
+func (r Rate) IsZero() bool {
+	return r.Requests == 0
+}
+
+// bucket is the state of a single key of MemoryLimiter.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// MemoryLimiter is a Limiter that keeps a token bucket per key in memory. Buckets that have
+// refilled completely are dropped from time to time, so idle keys do not accumulate.
+type MemoryLimiter struct {
+	rate    Rate
+	mtx     sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+	now     func() time.Time
+}
+
+// NewMemoryLimiter returns a MemoryLimiter that allows rate for every key.
+func NewMemoryLimiter(rate Rate) *MemoryLimiter {
+	return &MemoryLimiter{rate: rate, buckets: make(map[string]*bucket), now: time.Now}
+}
+
+// Allow takes a token from the bucket of key, if it has one left.
+func (l *MemoryLimiter) Allow(_ context.Context, key string) (bool, time.Duration, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := l.now()
+	capacity := float64(l.rate.Requests)
+	perToken := l.rate.Per / time.Duration(l.rate.Requests)
+
+	if now.Sub(l.swept) > l.rate.Per {
+		for k, b := range l.buckets {
+			if now.Sub(b.updated) >= l.rate.Per {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, updated: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(capacity, b.tokens+float64(now.Sub(b.updated))/float64(perToken))
+	b.updated = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) * float64(perToken)), nil
+	}
+
+	b.tokens--
+	return true, 0, nil
+}
+
+// RateLimit is a middleware that limits the requests of every user with limiter. Requests are
+// counted per user ID when the request was authenticated by an API key, and per client IP
+// otherwise. User ID cookies and tokens are minted for anyone who asks, so clients that drop or
+// replace them cannot escape the limit. The client IP is the one returned by util.ClientIP, and
+// so can only be taken from X-Real-IP by RealIP. A request over the limit gets
+// 429 Too Many Requests with a Retry-After header. A nil limiter lets every request through,
+// and so does an error of the limiter, which is logged.
+//
+// The middleware must be registered after APIKeyAuth.
+//
+// Usage:
+//
+//	limiter := middleware.NewMemoryLimiter(middleware.Rate{Requests: 60, Per: time.Minute})
+//	r.With(middleware.RateLimit(limiter)).Post("/", handler)
+func RateLimit(limiter Limiter) func(next http.Handler) http.Handler {
+	return rateLimit(limiter, func(r *http.Request) string {
+		userID, _ := r.Context().Value(ctxName).(string)
+		return RateLimitKey(userID, IsAPIKeyUser(r.Context()), util.ClientIP(r))
+	})
+}
+
+// RateLimitKey returns the key under which RateLimit counts a request of userID from clientIP:
+// the user ID when it was authenticated by an API key, and the client IP otherwise. It lets
+// other transports, such as gRPC, share the limiters and buckets of the HTTP routes.
+func RateLimitKey(userID string, isAPIKeyUser bool, clientIP string) string {
+	if userID != "" && isAPIKeyUser {
+		return "user:" + userID
+	}
+	return "ip:" + clientIP
+}
+
+// TakeToken takes a token for key from limiter and reports whether the request may go on and,
+// if it may not, how long to wait before retrying. An error of the limiter is logged and lets
+// the request through.
+func TakeToken(ctx context.Context, limiter Limiter, key string) (bool, time.Duration) {
+	ok, retryAfter, err := limiter.Allow(ctx, key)
+	if err != nil {
+		slog.Error("rate limiter failed", "error", err)
+		return true, 0
+	}
+
+	return ok, retryAfter
+}
+
+// RateLimitByIP is a middleware like RateLimit that always counts requests per client IP,
+// whoever the user is. It guards routes such as the account sign in, where a user ID does
+// not stand for the client making the attempts.
+func RateLimitByIP(limiter Limiter) func(next http.Handler) http.Handler {
+	return rateLimit(limiter, func(r *http.Request) string {
+		return "ip:" + util.ClientIP(r)
+	})
+}
+
+// rateLimit limits the requests with limiter, counting them under the key returned by key.
+func rateLimit(limiter Limiter, key func(r *http.Request) string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if limiter == nil {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ok, retryAfter := TakeToken(r.Context(), limiter, key(r)); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
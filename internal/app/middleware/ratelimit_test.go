@@ -0,0 +1,230 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/trunov/go-shortener/internal/app/util"
+)
+
+func Test_ParseRate(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Rate
+		wantErr bool
+	}{
+		{in: "", want: Rate{}},
+		{in: "60/1m", want: Rate{Requests: 60, Per: time.Minute}},
+		{in: "5/1s", want: Rate{Requests: 5, Per: time.Second}},
+		{in: "60", wantErr: true},
+		{in: "0/1m", wantErr: true},
+		{in: "ten/1m", wantErr: true},
+		{in: "10/soon", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseRate(tt.in)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_MemoryLimiter(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	l := NewMemoryLimiter(Rate{Requests: 2, Per: time.Second})
+	l.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		ok, _, err := l.Allow(ctx, "a")
+		require.NoError(t, err)
+		assert.True(t, ok)
+	}
+
+	ok, retryAfter, err := l.Allow(ctx, "a")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, retryAfter)
+
+	ok, _, err = l.Allow(ctx, "b")
+	require.NoError(t, err)
+	assert.True(t, ok, "keys have separate buckets")
+
+	now = now.Add(500 * time.Millisecond)
+	ok, _, err = l.Allow(ctx, "a")
+	require.NoError(t, err)
+	assert.True(t, ok, "a token is refilled")
+
+	now = now.Add(time.Hour)
+	_, _, err = l.Allow(ctx, "c")
+	require.NoError(t, err)
+	assert.Len(t, l.buckets, 1, "idle buckets are dropped")
+}
+
+func Test_RateLimit(t *testing.T) {
+	tests := []struct {
+		name       string
+		userID     string
+		newUser    bool
+		apiKey     bool
+		remoteAddr []string
+		realIP     string
+		wantStatus []int
+	}{
+		{
+			name:       "api key user is limited across addresses",
+			userID:     "user1",
+			apiKey:     true,
+			remoteAddr: []string{"10.0.0.1:1000", "10.0.0.2:1000"},
+			wantStatus: []int{http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name:       "new users are limited by address",
+			userID:     "random",
+			newUser:    true,
+			remoteAddr: []string{"10.0.0.1:1000", "10.0.0.1:2000", "10.0.0.2:1000"},
+			wantStatus: []int{http.StatusOK, http.StatusTooManyRequests, http.StatusOK},
+		},
+		{
+			name:       "cookie users are limited by address",
+			userID:     "user1",
+			remoteAddr: []string{"10.0.0.1:1000", "10.0.0.1:2000", "10.0.0.2:1000"},
+			wantStatus: []int{http.StatusOK, http.StatusTooManyRequests, http.StatusOK},
+		},
+		{
+			name:       "X-Real-IP is ignored",
+			userID:     "user1",
+			remoteAddr: []string{"10.0.0.1:1000", "10.0.0.1:2000"},
+			realIP:     "192.0.2.1",
+			wantStatus: []int{http.StatusOK, http.StatusTooManyRequests},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := NewMemoryLimiter(Rate{Requests: 1, Per: time.Minute})
+			h := RateLimit(limiter)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			for i, addr := range tt.remoteAddr {
+				ctx := context.WithValue(context.Background(), ctxName, tt.userID)
+				if tt.newUser {
+					ctx = context.WithValue(ctx, ctxNewUser, true)
+				}
+				if tt.apiKey {
+					ctx = context.WithValue(ctx, ctxAPIKey, true)
+				}
+
+				req := httptest.NewRequest(http.MethodPost, "/", nil).WithContext(ctx)
+				req.RemoteAddr = addr
+				if tt.realIP != "" {
+					req.Header.Set("X-Real-IP", fmt.Sprintf("%s%d", tt.realIP, i))
+				}
+
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, req)
+
+				require.Equal(t, tt.wantStatus[i], w.Code)
+				if w.Code == http.StatusTooManyRequests {
+					assert.Equal(t, "60", w.Header().Get("Retry-After"))
+				}
+			}
+		})
+	}
+}
+
+func Test_RealIP(t *testing.T) {
+	_, proxies, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name         string
+		trustedProxy *net.IPNet
+		remoteAddr   string
+		realIP       string
+		want         string
+	}{
+		{
+			name:         "header of a trusted proxy is used",
+			trustedProxy: proxies,
+			remoteAddr:   "10.0.0.1:1000",
+			realIP:       "192.0.2.1",
+			want:         "192.0.2.1",
+		},
+		{
+			name:         "header of a client is ignored",
+			trustedProxy: proxies,
+			remoteAddr:   "198.51.100.1:1000",
+			realIP:       "192.0.2.1",
+			want:         "198.51.100.1",
+		},
+		{
+			name:         "invalid header is ignored",
+			trustedProxy: proxies,
+			remoteAddr:   "10.0.0.1:1000",
+			realIP:       "not an ip",
+			want:         "10.0.0.1",
+		},
+		{
+			name:       "header is ignored without trusted proxies",
+			remoteAddr: "10.0.0.1:1000",
+			realIP:     "192.0.2.1",
+			want:       "10.0.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			h := RealIP(tt.trustedProxy)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = util.ClientIP(r)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set("X-Real-IP", tt.realIP)
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_RateLimitByIP(t *testing.T) {
+	limiter := NewMemoryLimiter(Rate{Requests: 1, Per: time.Minute})
+	h := RateLimitByIP(limiter)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i, tt := range []struct {
+		userID     string
+		remoteAddr string
+		wantStatus int
+	}{
+		{userID: "user1", remoteAddr: "10.0.0.1:1000", wantStatus: http.StatusOK},
+		{userID: "user2", remoteAddr: "10.0.0.1:2000", wantStatus: http.StatusTooManyRequests},
+		{userID: "user1", remoteAddr: "10.0.0.2:1000", wantStatus: http.StatusOK},
+	} {
+		ctx := context.WithValue(context.Background(), ctxName, tt.userID)
+		ctx = context.WithValue(ctx, ctxAPIKey, true)
+
+		req := httptest.NewRequest(http.MethodPost, "/api/user/login", nil).WithContext(ctx)
+		req.RemoteAddr = tt.remoteAddr
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		assert.Equal(t, tt.wantStatus, w.Code, i)
+	}
+}
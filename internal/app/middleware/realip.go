@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/trunov/go-shortener/internal/app/util"
+)
+
+// RealIP is a middleware that sets the remote address of a request to its "X-Real-IP" header,
+// but only when the request comes from a reverse proxy in trustedProxy. The header of any other
+// request is ignored, because clients could set it to escape rate limits. A nil trustedProxy
+// trusts no one.
+//
+// The middleware must be registered before any middleware that uses util.ClientIP.
+//
+// Usage:
+//
+//	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+//	r.Use(middleware.RealIP(proxies))
+func RealIP(trustedProxy *net.IPNet) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if trustedProxy == nil {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			peer := net.ParseIP(util.ClientIP(r))
+			realIP := net.ParseIP(r.Header.Get("X-Real-IP"))
+			if peer != nil && realIP != nil && trustedProxy.Contains(peer) {
+				r.RemoteAddr = realIP.String()
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
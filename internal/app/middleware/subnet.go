@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/trunov/go-shortener/internal/app/util"
+)
+
+// TrustedSubnet is a middleware that only lets a request through when its client address,
+// as returned by util.ClientIP, belongs to subnet. Every other request is rejected with
+// 403 Forbidden. A nil subnet rejects all requests.
+//
+// The "X-Real-IP" header is only taken into account when RealIP, registered before this
+// middleware, trusts the proxy that sent it; clients cannot get in by setting it themselves.
+//
+// Usage:
+//
+//	_, subnet, _ := net.ParseCIDR("192.168.1.0/24")
+//	r.Use(middleware.RealIP(proxies))
+//	r.With(middleware.TrustedSubnet(subnet)).Get("/api/internal/stats", handler)
+func TrustedSubnet(subnet *net.IPNet) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if subnet == nil {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			ip := net.ParseIP(util.ClientIP(r))
+			if ip == nil || !subnet.Contains(ip) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
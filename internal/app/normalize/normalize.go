@@ -0,0 +1,105 @@
+// Package normalize validates the URLs submitted for shortening and brings them into a canonical
+// form, so that equal destinations are stored, and deduplicated, as the same string.
+package normalize
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// MaxLength is the longest URL accepted, after normalization.
+const MaxLength = 2048
+
+// Reasons why a URL is rejected, returned in Error.Reason.
+const (
+	ReasonEmpty            = "empty"
+	ReasonTooLong          = "too_long"
+	ReasonMalformed        = "malformed"
+	ReasonMissingScheme    = "missing_scheme"
+	ReasonSchemeNotAllowed = "scheme_not_allowed"
+	ReasonMissingHost      = "missing_host"
+	ReasonInvalidHost      = "invalid_host"
+)
+
+// allowedSchemes lists the schemes that may be shortened, with their default ports.
+var allowedSchemes = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// Error is returned for a URL that cannot be shortened. Reason is one of the Reason
+// constants and is meant for clients, Message explains it to people.
+type Error struct {
+	Reason  string
+	Message string
+}
+
+// Error returns the message of the error.
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func invalid(reason, format string, args ...interface{}) *Error {
+	return &Error{Reason: reason, Message: fmt.Sprintf(format, args...)}
+}
+
+// URL validates raw and returns it in its normalized form: surrounding whitespace removed,
+// scheme and host lower-cased, an internationalized host converted to punycode and a default
+// port dropped. Path, query and fragment are kept as they are.
+func URL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", invalid(ReasonEmpty, "url is empty")
+	}
+	if len(raw) > MaxLength {
+		return "", invalid(ReasonTooLong, "url is longer than %d characters", MaxLength)
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", invalid(ReasonMalformed, "url is malformed")
+	}
+
+	if u.Scheme == "" {
+		return "", invalid(ReasonMissingScheme, "url must be absolute")
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	defaultPort, ok := allowedSchemes[u.Scheme]
+	if !ok {
+		return "", invalid(ReasonSchemeNotAllowed, "scheme %q is not allowed", u.Scheme)
+	}
+
+	host := u.Hostname()
+	if host == "" {
+		return "", invalid(ReasonMissingHost, "url must have a host")
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+		if ip.To4() == nil {
+			host = "[" + host + "]"
+		}
+	} else {
+		host, err = idna.Lookup.ToASCII(strings.ToLower(strings.TrimSuffix(host, ".")))
+		if err != nil {
+			return "", invalid(ReasonInvalidHost, "host is invalid")
+		}
+	}
+
+	if port := u.Port(); port != "" && port != defaultPort {
+		host += ":" + port
+	}
+	u.Host = host
+
+	normalized := u.String()
+	if len(normalized) > MaxLength {
+		return "", invalid(ReasonTooLong, "url is longer than %d characters", MaxLength)
+	}
+
+	return normalized, nil
+}
@@ -0,0 +1,50 @@
+package normalize
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestURL(t *testing.T) {
+	tests := []struct {
+		name       string
+		raw        string
+		want       string
+		wantReason string
+	}{
+		{name: "already normalized", raw: "https://go.dev/doc?q=1#top", want: "https://go.dev/doc?q=1#top"},
+		{name: "surrounding whitespace", raw: "  https://go.dev/doc \n", want: "https://go.dev/doc"},
+		{name: "upper case scheme and host", raw: "HTTPS://Go.DEV/Doc", want: "https://go.dev/Doc"},
+		{name: "default http port", raw: "http://example.com:80/a", want: "http://example.com/a"},
+		{name: "default https port", raw: "https://example.com:443", want: "https://example.com"},
+		{name: "other port kept", raw: "https://example.com:8443/a", want: "https://example.com:8443/a"},
+		{name: "idn host", raw: "https://Bücher.example/katalog", want: "https://xn--bcher-kva.example/katalog"},
+		{name: "ipv6 host", raw: "http://[::1]:80/a", want: "http://[::1]/a"},
+		{name: "empty", raw: " \t", wantReason: ReasonEmpty},
+		{name: "too long", raw: "https://example.com/" + strings.Repeat("a", MaxLength), wantReason: ReasonTooLong},
+		{name: "malformed", raw: "https://exa mple.com/%zz", wantReason: ReasonMalformed},
+		{name: "relative path", raw: "/spring-sale", wantReason: ReasonMissingScheme},
+		{name: "javascript", raw: "javascript:alert(1)", wantReason: ReasonSchemeNotAllowed},
+		{name: "ftp", raw: "ftp://example.com/file", wantReason: ReasonSchemeNotAllowed},
+		{name: "missing host", raw: "https:///path", wantReason: ReasonMissingHost},
+		{name: "invalid host", raw: "https://exa_mple.com", wantReason: ReasonInvalidHost},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := URL(tt.raw)
+			if tt.wantReason != "" {
+				var e *Error
+				require.ErrorAs(t, err, &e)
+				assert.Equal(t, tt.wantReason, e.Reason)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
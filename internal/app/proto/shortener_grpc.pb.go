@@ -0,0 +1,384 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v4.24.4
+// source: shortener.proto
+
+package proto
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Shortener_Shorten_FullMethodName         = "/shortener.Shortener/Shorten"
+	Shortener_ShortenBatch_FullMethodName    = "/shortener.Shortener/ShortenBatch"
+	Shortener_Get_FullMethodName             = "/shortener.Shortener/Get"
+	Shortener_GetUserURLs_FullMethodName     = "/shortener.Shortener/GetUserURLs"
+	Shortener_DeleteUserURLs_FullMethodName  = "/shortener.Shortener/DeleteUserURLs"
+	Shortener_RestoreUserURLs_FullMethodName = "/shortener.Shortener/RestoreUserURLs"
+	Shortener_GetDeleteJob_FullMethodName    = "/shortener.Shortener/GetDeleteJob"
+	Shortener_Ping_FullMethodName            = "/shortener.Shortener/Ping"
+)
+
+// ShortenerClient is the client API for Shortener service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ShortenerClient interface {
+	// Shorten creates a short URL for the given original URL.
+	Shorten(ctx context.Context, in *ShortenRequest, opts ...grpc.CallOption) (*ShortenResponse, error)
+	// ShortenBatch creates short URLs for several original URLs at once.
+	ShortenBatch(ctx context.Context, in *ShortenBatchRequest, opts ...grpc.CallOption) (*ShortenBatchResponse, error)
+	// Get returns the original URL behind a short key.
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error)
+	// GetUserURLs returns the URLs shortened by the calling user, one page at a time.
+	GetUserURLs(ctx context.Context, in *GetUserURLsRequest, opts ...grpc.CallOption) (*GetUserURLsResponse, error)
+	// DeleteUserURLs schedules the deletion of the given keys owned by the calling user.
+	DeleteUserURLs(ctx context.Context, in *DeleteUserURLsRequest, opts ...grpc.CallOption) (*DeleteUserURLsResponse, error)
+	// RestoreUserURLs restores the given deleted keys owned by the calling user.
+	RestoreUserURLs(ctx context.Context, in *RestoreUserURLsRequest, opts ...grpc.CallOption) (*RestoreUserURLsResponse, error)
+	// GetDeleteJob returns the state of a deletion started by the calling user.
+	GetDeleteJob(ctx context.Context, in *GetDeleteJobRequest, opts ...grpc.CallOption) (*DeleteJob, error)
+	// Ping checks the database connection.
+	Ping(ctx context.Context, in *PingRequest, opts ...grpc.CallOption) (*PingResponse, error)
+}
+
+type shortenerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewShortenerClient(cc grpc.ClientConnInterface) ShortenerClient {
+	return &shortenerClient{cc}
+}
+
+func (c *shortenerClient) Shorten(ctx context.Context, in *ShortenRequest, opts ...grpc.CallOption) (*ShortenResponse, error) {
+	out := new(ShortenResponse)
+	err := c.cc.Invoke(ctx, Shortener_Shorten_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *shortenerClient) ShortenBatch(ctx context.Context, in *ShortenBatchRequest, opts ...grpc.CallOption) (*ShortenBatchResponse, error) {
+	out := new(ShortenBatchResponse)
+	err := c.cc.Invoke(ctx, Shortener_ShortenBatch_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *shortenerClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error) {
+	out := new(GetResponse)
+	err := c.cc.Invoke(ctx, Shortener_Get_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *shortenerClient) GetUserURLs(ctx context.Context, in *GetUserURLsRequest, opts ...grpc.CallOption) (*GetUserURLsResponse, error) {
+	out := new(GetUserURLsResponse)
+	err := c.cc.Invoke(ctx, Shortener_GetUserURLs_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *shortenerClient) DeleteUserURLs(ctx context.Context, in *DeleteUserURLsRequest, opts ...grpc.CallOption) (*DeleteUserURLsResponse, error) {
+	out := new(DeleteUserURLsResponse)
+	err := c.cc.Invoke(ctx, Shortener_DeleteUserURLs_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *shortenerClient) RestoreUserURLs(ctx context.Context, in *RestoreUserURLsRequest, opts ...grpc.CallOption) (*RestoreUserURLsResponse, error) {
+	out := new(RestoreUserURLsResponse)
+	err := c.cc.Invoke(ctx, Shortener_RestoreUserURLs_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *shortenerClient) GetDeleteJob(ctx context.Context, in *GetDeleteJobRequest, opts ...grpc.CallOption) (*DeleteJob, error) {
+	out := new(DeleteJob)
+	err := c.cc.Invoke(ctx, Shortener_GetDeleteJob_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *shortenerClient) Ping(ctx context.Context, in *PingRequest, opts ...grpc.CallOption) (*PingResponse, error) {
+	out := new(PingResponse)
+	err := c.cc.Invoke(ctx, Shortener_Ping_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ShortenerServer is the server API for Shortener service.
+// All implementations must embed UnimplementedShortenerServer
+// for forward compatibility
+type ShortenerServer interface {
+	// Shorten creates a short URL for the given original URL.
+	Shorten(context.Context, *ShortenRequest) (*ShortenResponse, error)
+	// ShortenBatch creates short URLs for several original URLs at once.
+	ShortenBatch(context.Context, *ShortenBatchRequest) (*ShortenBatchResponse, error)
+	// Get returns the original URL behind a short key.
+	Get(context.Context, *GetRequest) (*GetResponse, error)
+	// GetUserURLs returns the URLs shortened by the calling user, one page at a time.
+	GetUserURLs(context.Context, *GetUserURLsRequest) (*GetUserURLsResponse, error)
+	// DeleteUserURLs schedules the deletion of the given keys owned by the calling user.
+	DeleteUserURLs(context.Context, *DeleteUserURLsRequest) (*DeleteUserURLsResponse, error)
+	// RestoreUserURLs restores the given deleted keys owned by the calling user.
+	RestoreUserURLs(context.Context, *RestoreUserURLsRequest) (*RestoreUserURLsResponse, error)
+	// GetDeleteJob returns the state of a deletion started by the calling user.
+	GetDeleteJob(context.Context, *GetDeleteJobRequest) (*DeleteJob, error)
+	// Ping checks the database connection.
+	Ping(context.Context, *PingRequest) (*PingResponse, error)
+	mustEmbedUnimplementedShortenerServer()
+}
+
+// UnimplementedShortenerServer must be embedded to have forward compatible implementations.
+type UnimplementedShortenerServer struct {
+}
+
+func (UnimplementedShortenerServer) Shorten(context.Context, *ShortenRequest) (*ShortenResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Shorten not implemented")
+}
+func (UnimplementedShortenerServer) ShortenBatch(context.Context, *ShortenBatchRequest) (*ShortenBatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ShortenBatch not implemented")
+}
+func (UnimplementedShortenerServer) Get(context.Context, *GetRequest) (*GetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedShortenerServer) GetUserURLs(context.Context, *GetUserURLsRequest) (*GetUserURLsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUserURLs not implemented")
+}
+func (UnimplementedShortenerServer) DeleteUserURLs(context.Context, *DeleteUserURLsRequest) (*DeleteUserURLsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteUserURLs not implemented")
+}
+func (UnimplementedShortenerServer) RestoreUserURLs(context.Context, *RestoreUserURLsRequest) (*RestoreUserURLsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RestoreUserURLs not implemented")
+}
+func (UnimplementedShortenerServer) GetDeleteJob(context.Context, *GetDeleteJobRequest) (*DeleteJob, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetDeleteJob not implemented")
+}
+func (UnimplementedShortenerServer) Ping(context.Context, *PingRequest) (*PingResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Ping not implemented")
+}
+func (UnimplementedShortenerServer) mustEmbedUnimplementedShortenerServer() {}
+
+// UnsafeShortenerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ShortenerServer will
+// result in compilation errors.
+type UnsafeShortenerServer interface {
+	mustEmbedUnimplementedShortenerServer()
+}
+
+func RegisterShortenerServer(s grpc.ServiceRegistrar, srv ShortenerServer) {
+	s.RegisterService(&Shortener_ServiceDesc, srv)
+}
+
+func _Shortener_Shorten_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ShortenRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ShortenerServer).Shorten(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Shortener_Shorten_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ShortenerServer).Shorten(ctx, req.(*ShortenRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Shortener_ShortenBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ShortenBatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ShortenerServer).ShortenBatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Shortener_ShortenBatch_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ShortenerServer).ShortenBatch(ctx, req.(*ShortenBatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Shortener_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ShortenerServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Shortener_Get_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ShortenerServer).Get(ctx, req.(*GetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Shortener_GetUserURLs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetUserURLsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ShortenerServer).GetUserURLs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Shortener_GetUserURLs_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ShortenerServer).GetUserURLs(ctx, req.(*GetUserURLsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Shortener_DeleteUserURLs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteUserURLsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ShortenerServer).DeleteUserURLs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Shortener_DeleteUserURLs_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ShortenerServer).DeleteUserURLs(ctx, req.(*DeleteUserURLsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Shortener_RestoreUserURLs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RestoreUserURLsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ShortenerServer).RestoreUserURLs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Shortener_RestoreUserURLs_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ShortenerServer).RestoreUserURLs(ctx, req.(*RestoreUserURLsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Shortener_GetDeleteJob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetDeleteJobRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ShortenerServer).GetDeleteJob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Shortener_GetDeleteJob_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ShortenerServer).GetDeleteJob(ctx, req.(*GetDeleteJobRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Shortener_Ping_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PingRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ShortenerServer).Ping(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Shortener_Ping_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ShortenerServer).Ping(ctx, req.(*PingRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Shortener_ServiceDesc is the grpc.ServiceDesc for Shortener service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Shortener_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "shortener.Shortener",
+	HandlerType: (*ShortenerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Shorten",
+			Handler:    _Shortener_Shorten_Handler,
+		},
+		{
+			MethodName: "ShortenBatch",
+			Handler:    _Shortener_ShortenBatch_Handler,
+		},
+		{
+			MethodName: "Get",
+			Handler:    _Shortener_Get_Handler,
+		},
+		{
+			MethodName: "GetUserURLs",
+			Handler:    _Shortener_GetUserURLs_Handler,
+		},
+		{
+			MethodName: "DeleteUserURLs",
+			Handler:    _Shortener_DeleteUserURLs_Handler,
+		},
+		{
+			MethodName: "RestoreUserURLs",
+			Handler:    _Shortener_RestoreUserURLs_Handler,
+		},
+		{
+			MethodName: "GetDeleteJob",
+			Handler:    _Shortener_GetDeleteJob_Handler,
+		},
+		{
+			MethodName: "Ping",
+			Handler:    _Shortener_Ping_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "shortener.proto",
+}
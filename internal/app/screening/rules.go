@@ -0,0 +1,145 @@
+// Package screening checks the destinations of short links against a local list of blocked and
+// allowed domains, so that the shortener cannot be used to mask phishing or other abusive links.
+package screening
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Reasons why a destination is rejected, returned in Error.Reason.
+const (
+	ReasonBlocked       = "blocked"
+	ReasonSelfReference = "self_reference"
+)
+
+// Error is returned for a destination that may not be shortened or redirected to.
+type Error struct {
+	Reason  string
+	Message string
+}
+
+// Error returns the message of the error.
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// rule matches a destination by its exact host, by a host suffix or by a regular expression.
+type rule struct {
+	domain string
+	suffix string
+	re     *regexp.Regexp
+}
+
+func (r rule) match(host, link string) bool {
+	switch {
+	case r.re != nil:
+		return r.re.MatchString(link)
+	case r.suffix != "":
+		return host == r.suffix || strings.HasSuffix(host, "."+r.suffix)
+	default:
+		return host == r.domain
+	}
+}
+
+// Rules is a parsed list of block and allow rules. A destination is blocked when it matches
+// a block rule and no allow rule, so allow rules carve exceptions out of broader block rules.
+// The zero value blocks nothing.
+type Rules struct {
+	block []rule
+	allow []rule
+}
+
+// Parse reads rules from r, one per line in the form "<action> <kind> <pattern>", where action is
+// "block" or "allow" and kind is one of:
+//
+//	domain  the host of the destination equals pattern
+//	suffix  the host equals pattern or is a subdomain of it
+//	regex   the whole destination URL matches the regular expression pattern
+//
+// Empty lines and lines starting with # are ignored. Domains are compared in lower case punycode.
+func Parse(r io.Reader) (*Rules, error) {
+	rules := &Rules{}
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected <action> <kind> <pattern>", n)
+		}
+
+		rl, err := parseRule(fields[1], fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+
+		switch fields[0] {
+		case "block":
+			rules.block = append(rules.block, rl)
+		case "allow":
+			rules.allow = append(rules.allow, rl)
+		default:
+			return nil, fmt.Errorf("line %d: unknown action %q", n, fields[0])
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func parseRule(kind, pattern string) (rule, error) {
+	switch kind {
+	case "domain", "suffix":
+		host, err := idna.Lookup.ToASCII(strings.ToLower(strings.Trim(pattern, ".")))
+		if err != nil {
+			return rule{}, fmt.Errorf("invalid domain %q: %w", pattern, err)
+		}
+
+		if kind == "domain" {
+			return rule{domain: host}, nil
+		}
+		return rule{suffix: host}, nil
+	case "regex":
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return rule{}, err
+		}
+		return rule{re: re}, nil
+	default:
+		return rule{}, fmt.Errorf("unknown kind %q", kind)
+	}
+}
+
+// Blocked reports whether the destination u is blocked by the rules.
+func (r *Rules) Blocked(u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	link := u.String()
+
+	for _, rl := range r.allow {
+		if rl.match(host, link) {
+			return false
+		}
+	}
+
+	for _, rl := range r.block {
+		if rl.match(host, link) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,163 @@
+package screening
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/net/idna"
+
+	"github.com/trunov/go-shortener/internal/app/normalize"
+)
+
+// Screener checks destinations against the rules of a file and against the shortener's own host.
+// The rules are replaced atomically, so Check is safe to call while the file is reloaded.
+type Screener struct {
+	path     string
+	selfHost string
+	selfPort string
+	rules    atomic.Pointer[Rules]
+	watcher  *fsnotify.Watcher
+}
+
+// NewScreener returns a Screener that rejects links to the host of baseURL and, unless path
+// is empty, the links blocked by the rules in the file at path.
+func NewScreener(path, baseURL string) (*Screener, error) {
+	s := &Screener{path: path}
+
+	if baseURL != "" {
+		base, err := normalize.URL(baseURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base URL: %w", err)
+		}
+
+		u, err := url.Parse(base)
+		if err != nil {
+			return nil, err
+		}
+		s.selfHost, s.selfPort = hostPort(u)
+	}
+
+	s.rules.Store(&Rules{})
+	if path != "" {
+		if err := s.Reload(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Reload reads the rules file again. On error the previous rules stay in effect.
+func (s *Screener) Reload() error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rules, err := Parse(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+
+	s.rules.Store(rules)
+	return nil
+}
+
+// Watch reloads the rules whenever the file changes, until Close is called. The directory of the
+// file is watched rather than the file itself, so that editors replacing the file are noticed too.
+func (s *Screener) Watch() error {
+	if s.path == "" {
+		return nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	if err := watcher.Add(filepath.Dir(s.path)); err != nil {
+		watcher.Close()
+		return err
+	}
+	s.watcher = watcher
+
+	go func() {
+		name := filepath.Clean(s.path)
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != name || !(event.Has(fsnotify.Write) || event.Has(fsnotify.Create)) {
+					continue
+				}
+
+				if err := s.Reload(); err != nil {
+					slog.Error("failed to reload screening rules", "error", err)
+					continue
+				}
+				slog.Info("reloaded screening rules", "path", s.path)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Error("screening rules watcher failed", "error", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Close stops watching the rules file.
+func (s *Screener) Close() error {
+	if s.watcher == nil {
+		return nil
+	}
+	return s.watcher.Close()
+}
+
+// hostPort returns the hostname of u in lower case, without a trailing dot and in its ASCII form,
+// and the port of u. The default ports 80 and 443 are returned as an empty port, since either can
+// reach the same server, for example behind a proxy that terminates TLS.
+func hostPort(u *url.URL) (string, string) {
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+		host = ascii
+	}
+
+	port := u.Port()
+	if port == "80" || port == "443" {
+		port = ""
+	}
+
+	return host, port
+}
+
+// Check returns an *Error if link points back at the shortener itself or is blocked by the rules.
+// link is expected to be normalized already, but variants of the shortener's own host in case,
+// trailing dot or default port are recognized either way.
+func (s *Screener) Check(link string) error {
+	u, err := url.Parse(link)
+	if err != nil {
+		return err
+	}
+
+	if host, port := hostPort(u); s.selfHost != "" && host == s.selfHost && port == s.selfPort {
+		return &Error{Reason: ReasonSelfReference, Message: "url points back at the shortener"}
+	}
+
+	if s.rules.Load().Blocked(u) {
+		return &Error{Reason: ReasonBlocked, Message: "url is blocked"}
+	}
+
+	return nil
+}
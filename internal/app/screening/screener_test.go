@@ -0,0 +1,131 @@
+package screening
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRules = `
+# phishing campaigns
+block domain evil.example
+block suffix bad.example
+allow domain safe.bad.example
+block regex ^https://[^/]+/wp-login\.php
+block suffix bücher.example
+`
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   string
+		wantErr bool
+	}{
+		{name: "valid", rules: testRules},
+		{name: "missing pattern", rules: "block domain", wantErr: true},
+		{name: "unknown action", rules: "deny domain evil.example", wantErr: true},
+		{name: "unknown kind", rules: "block host evil.example", wantErr: true},
+		{name: "invalid regex", rules: "block regex [", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tt.rules))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestScreener_Check(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist")
+	require.NoError(t, os.WriteFile(path, []byte(testRules), 0o600))
+
+	s, err := NewScreener(path, "http://localhost:8080")
+	require.NoError(t, err)
+
+	tests := []struct {
+		link       string
+		wantReason string
+	}{
+		{link: "https://go.dev/doc"},
+		{link: "https://evil.example/login", wantReason: ReasonBlocked},
+		{link: "https://not-evil.example/login"},
+		{link: "https://www.bad.example", wantReason: ReasonBlocked},
+		{link: "https://bad.example", wantReason: ReasonBlocked},
+		{link: "https://safe.bad.example"},
+		{link: "https://go.dev/wp-login.php", wantReason: ReasonBlocked},
+		{link: "https://shop.xn--bcher-kva.example", wantReason: ReasonBlocked},
+		{link: "http://localhost:8080/12345678", wantReason: ReasonSelfReference},
+		{link: "http://localhost:9090/12345678"},
+		{link: "http://localhost/12345678"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.link, func(t *testing.T) {
+			err := s.Check(tt.link)
+			if tt.wantReason == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			var e *Error
+			require.ErrorAs(t, err, &e)
+			assert.Equal(t, tt.wantReason, e.Reason)
+		})
+	}
+}
+
+func TestScreener_CheckSelfReferenceVariants(t *testing.T) {
+	s, err := NewScreener("", "https://short.example")
+	require.NoError(t, err)
+
+	for _, link := range []string{
+		"https://short.example/12345678",
+		"http://short.example/12345678",
+		"http://short.example:443/12345678",
+		"https://short.example:80/12345678",
+		"HTTP://SHORT.EXAMPLE./12345678",
+		"https://Short.Example:443",
+	} {
+		t.Run(link, func(t *testing.T) {
+			var e *Error
+			require.ErrorAs(t, s.Check(link), &e)
+			assert.Equal(t, ReasonSelfReference, e.Reason)
+		})
+	}
+
+	assert.NoError(t, s.Check("https://short.example:8443/12345678"))
+	assert.NoError(t, s.Check("https://other.short.example/12345678"))
+}
+
+func TestScreener_Watch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist")
+	require.NoError(t, os.WriteFile(path, []byte("block domain evil.example\n"), 0o600))
+
+	s, err := NewScreener(path, "")
+	require.NoError(t, err)
+	require.NoError(t, s.Watch())
+	defer s.Close()
+
+	require.Error(t, s.Check("https://evil.example"))
+	require.NoError(t, s.Check("https://worse.example"))
+
+	// An invalid file keeps the previous rules.
+	require.NoError(t, os.WriteFile(path, []byte("block nonsense\n"), 0o600))
+	time.Sleep(50 * time.Millisecond)
+	require.Error(t, s.Check("https://evil.example"))
+
+	require.NoError(t, os.WriteFile(path, []byte("block domain worse.example\n"), 0o600))
+	assert.Eventually(t, func() bool {
+		return s.Check("https://worse.example") != nil && s.Check("https://evil.example") == nil
+	}, 2*time.Second, 10*time.Millisecond)
+}
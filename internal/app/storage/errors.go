@@ -0,0 +1,27 @@
+// Package storage defines the errors shared by the storage backends of the URL shortener.
+// Every backend wraps them, so that callers can tell failures apart with errors.Is
+// instead of inspecting error messages.
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNotFound means that the requested key or job does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict means that the change collides with an existing entry.
+	ErrConflict = errors.New("conflict")
+	// ErrGone means that the key exists but has been deleted or has expired.
+	ErrGone = errors.New("gone")
+	// ErrForbidden means that the key belongs to another user.
+	ErrForbidden = errors.New("forbidden")
+)
+
+var (
+	// ErrKeyTaken is an ErrConflict on the short key.
+	ErrKeyTaken = fmt.Errorf("%w: key is already taken", ErrConflict)
+	// ErrDuplicateURL is an ErrConflict on the original URL in its deduplication scope.
+	ErrDuplicateURL = fmt.Errorf("%w: url is already shortened", ErrConflict)
+)
@@ -3,25 +3,126 @@ package memory
 
 import (
 	"context"
-	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/trunov/go-shortener/internal/app/file"
+	"github.com/trunov/go-shortener/internal/app/storage"
 	"github.com/trunov/go-shortener/internal/app/util"
 )
 
 // Storage represents the in-memory storage structure with mutex protection.
 type Storage struct {
-	keysLinksUserID util.KeysLinksUserID
-	mtx             sync.RWMutex
-	fileName        string
+	keysLinksUserID  util.KeysLinksUserID
+	clicks           map[string][]util.Click
+	revisions        map[string][]util.Revision
+	deleteJobs       map[string]util.DeleteJob
+	apiKeys          map[string]util.APIKey
+	apiKeyHashes     map[string]string
+	accounts         map[string]util.Account
+	accountUsers     map[string]string
+	mtx              sync.RWMutex
+	fileName         string
+	jobsFileName     string
+	keysFileName     string
+	accountsFileName string
+	dedupMode        string
 }
 
 // NewStorage initializes a new Storage with the provided data and returns its pointer.
-func NewStorage(keysAndLinks util.KeysLinksUserID, fileName string) *Storage {
-	return &Storage{keysLinksUserID: keysAndLinks, fileName: fileName}
+// When fileName is set, delete jobs are journaled to fileName with the ".jobs" suffix,
+// API keys to fileName with the ".keys" suffix and accounts to fileName with the ".accounts" suffix.
+// dedupMode is one of the util.Dedup modes and decides which URLs conflict on insert.
+func NewStorage(keysAndLinks util.KeysLinksUserID, fileName, dedupMode string) *Storage {
+	s := &Storage{
+		keysLinksUserID: keysAndLinks,
+		clicks:          make(map[string][]util.Click),
+		revisions:       make(map[string][]util.Revision),
+		deleteJobs:      make(map[string]util.DeleteJob),
+		apiKeys:         make(map[string]util.APIKey),
+		apiKeyHashes:    make(map[string]string),
+		accounts:        make(map[string]util.Account),
+		accountUsers:    make(map[string]string),
+		fileName:        fileName,
+		dedupMode:       dedupMode,
+	}
+
+	if fileName != "" {
+		s.jobsFileName = fileName + ".jobs"
+		s.keysFileName = fileName + ".keys"
+		s.accountsFileName = fileName + ".accounts"
+	}
+
+	return s
+}
+
+// LoadDeleteJobs reads the delete jobs from the journal file and compacts it.
+// It does nothing when the storage has no file.
+func (s *Storage) LoadDeleteJobs() error {
+	if s.jobsFileName == "" {
+		return nil
+	}
+
+	jobs, err := file.ReadDeleteJobs(s.jobsFileName)
+	if err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.deleteJobs = jobs
+	return file.WriteDeleteJobs(s.jobsFileName, s.deleteJobs)
+}
+
+// LoadAPIKeys reads the API keys from the key file. It does nothing when the storage has no file.
+func (s *Storage) LoadAPIKeys() error {
+	if s.keysFileName == "" {
+		return nil
+	}
+
+	keys, err := file.ReadAPIKeys(s.keysFileName)
+	if err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.apiKeys = keys
+	s.apiKeyHashes = make(map[string]string, len(keys))
+	for id, key := range keys {
+		s.apiKeyHashes[key.Hash] = id
+	}
+
+	return nil
+}
+
+// LoadAccounts reads the accounts from the account file. It does nothing when the storage has no file.
+func (s *Storage) LoadAccounts() error {
+	if s.accountsFileName == "" {
+		return nil
+	}
+
+	accounts, err := file.ReadAccounts(s.accountsFileName)
+	if err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.accounts = accounts
+	s.accountUsers = make(map[string]string, len(accounts))
+	for username, account := range accounts {
+		s.accountUsers[account.UserID] = username
+	}
+
+	return nil
 }
 
 // Get retrieves the original URL and its deletion status associated with a given key from the storage.
@@ -32,96 +133,723 @@ func (s *Storage) Get(_ context.Context, key string) (util.ShortenerGet, error)
 	v, ok := s.keysLinksUserID[key]
 
 	if !ok {
-		return shortener, fmt.Errorf("value %s not found", key)
+		return shortener, fmt.Errorf("%w: value %s", storage.ErrNotFound, key)
 	}
 
-	shortener = util.ShortenerGet{OriginalURL: v.Link, IsDeleted: v.IsDeleted}
+	shortener = util.ShortenerGet{OriginalURL: v.Link, UserID: v.UserID, IsDeleted: v.IsDeleted, ExpiresAt: v.ExpiresAt}
 	return shortener, nil
 }
 
-func (s *Storage) add(ctx context.Context, key, link, userID string) error {
+func (s *Storage) add(_ context.Context, key string, v util.MapValue) error {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
-	_, err := s.GetShortenKey(ctx, link)
+	if s.keyTaken(key) {
+		return storage.ErrKeyTaken
+	}
+
+	if _, ok := s.findConflict(key, v.Link, util.DedupScope(s.dedupMode, v.UserID, key)); ok {
+		return storage.ErrDuplicateURL
+	}
 
-	if err == nil {
-		return errors.New("found entry")
+	s.removeKey(key)
+	s.keysLinksUserID[key] = v
+
+	if err := s.writeToFile(map[string]util.MapValue{key: v}); err != nil {
+		slog.Error("failed to write storage file", "error", err)
 	}
 
-	s.keysLinksUserID[key] = util.MapValue{Link: link, UserID: userID, IsDeleted: false}
 	return nil
 }
 
-// Add inserts a new shortened URL entry into the storage.
-// If a fileName is set in the storage, the new entry is also written to a file.
-func (s *Storage) Add(ctx context.Context, key, link, userID string) error {
-	err := s.add(ctx, key, link, userID)
+// writeToFile appends the given entries to the storage file, if the storage has one.
+func (s *Storage) writeToFile(entries map[string]util.MapValue) error {
+	if s.fileName == "" || len(entries) == 0 {
+		return nil
+	}
 
+	p, err := file.NewWriter(s.fileName)
 	if err != nil {
 		return err
 	}
+	defer p.Close()
 
-	if s.fileName != "" {
-		p, err := file.NewWriter(s.fileName)
-		if err != nil {
-			log.Println(err)
+	for key, v := range entries {
+		if err := p.WriteKeyLinkUserID(key, v); err != nil {
+			return err
 		}
-		defer p.Close()
-		p.WriteKeyLinkUserID(key, link, userID)
 	}
 
 	return nil
 }
 
-// GetShortenKey finds and returns the key for a given original URL.
-func (s *Storage) GetShortenKey(_ context.Context, originalURL string) (string, error) {
+// writePurgedToFile records the removal of the given keys in the storage file, if the storage has one.
+func (s *Storage) writePurgedToFile(keys []string) error {
+	if s.fileName == "" || len(keys) == 0 {
+		return nil
+	}
+
+	p, err := file.NewWriter(s.fileName)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	for _, key := range keys {
+		if err := p.WritePurgedKey(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Add inserts a new shortened URL entry into the storage.
+// If a fileName is set in the storage, the new entry is also written to a file.
+func (s *Storage) Add(ctx context.Context, key, link, userID string, expiresAt *time.Time) error {
+	return s.add(ctx, key, util.MapValue{Link: link, UserID: userID, ExpiresAt: expiresAt, CreatedAt: time.Now().UTC()})
+}
+
+// UpdateURL replaces the original URL of a key owned by the user and records the previous one
+// as a revision. If a fileName is set in the storage, the new destination is also written to a file.
+func (s *Storage) UpdateURL(_ context.Context, userID, key, originalURL string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	v, ok := s.keysLinksUserID[key]
+	if !ok {
+		return fmt.Errorf("%w: value %s", storage.ErrNotFound, key)
+	}
+
+	if v.UserID != userID {
+		return storage.ErrForbidden
+	}
+
+	if v.IsDeleted {
+		return storage.ErrGone
+	}
+
+	if _, ok := s.findConflict(key, originalURL, s.dedupScope(key, v)); ok {
+		return storage.ErrDuplicateURL
+	}
+
+	updated := v
+	updated.Link = originalURL
+	if err := s.writeToFile(map[string]util.MapValue{key: updated}); err != nil {
+		return err
+	}
+
+	s.revisions[key] = append(s.revisions[key], util.Revision{OriginalURL: v.Link, ChangedAt: time.Now().UTC()})
+	s.keysLinksUserID[key] = updated
+
+	return nil
+}
+
+// GetRevisions returns the earlier original URLs of a key, oldest first.
+func (s *Storage) GetRevisions(_ context.Context, key string) ([]util.Revision, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	revisions := make([]util.Revision, len(s.revisions[key]))
+	copy(revisions, s.revisions[key])
+
+	return revisions, nil
+}
+
+// GetShortenKey finds and returns the key that a new URL of the user would conflict with
+// for a given original URL.
+func (s *Storage) GetShortenKey(_ context.Context, originalURL, userID string) (string, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if k, ok := s.findConflict("", originalURL, util.DedupScope(s.dedupMode, userID, "")); ok {
+		return k, nil
+	}
+
+	return "", fmt.Errorf("%w: url %s", storage.ErrNotFound, originalURL)
+}
+
+// findConflict returns another key with originalURL in the deduplication scope. Expired keys are
+// ignored even before DeleteExpired removes them. Links of another dedup mode can share a scope,
+// in which case the oldest one is returned, like the one the database keeps in the scope.
+// The caller must hold the mutex.
+func (s *Storage) findConflict(key, originalURL, scope string) (string, bool) {
+	now := time.Now()
+
+	found := ""
 	for k, v := range s.keysLinksUserID {
-		if v.Link == originalURL {
-			return k, nil
+		if k == key || v.Link != originalURL || v.IsExpired(now) || s.dedupScope(k, v) != scope {
+			continue
+		}
+
+		if found == "" {
+			found = k
+			continue
+		}
+
+		oldest := s.keysLinksUserID[found]
+		if v.CreatedAt.Before(oldest.CreatedAt) || v.CreatedAt.Equal(oldest.CreatedAt) && k < found {
+			found = k
 		}
 	}
 
-	return "", errors.New("not found")
+	return found, found != ""
 }
 
-// GetAllLinksByUserID fetches all the short URLs associated with a user ID and returns them.
-func (s *Storage) GetAllLinksByUserID(_ context.Context, userID, baseURL string) ([]util.AllURLSResponse, error) {
-	allUrls := []util.AllURLSResponse{}
+// dedupScope returns the deduplication scope of the link v stored under key, like the dedup_scope
+// column of the database.
+func (s *Storage) dedupScope(key string, v util.MapValue) string {
+	if v.DedupExcluded {
+		return util.DedupScope(util.DedupNone, v.UserID, key)
+	}
+	return util.DedupScope(s.dedupMode, v.UserID, key)
+}
+
+// keyTaken reports whether key is used by a link that has not expired. The caller must hold the mutex.
+func (s *Storage) keyTaken(key string) bool {
+	v, ok := s.keysLinksUserID[key]
+	return ok && !v.IsExpired(time.Now())
+}
+
+// removeKey removes key along with its revisions and clicks, so that a link created later
+// with the same key starts afresh. The caller must hold the write lock.
+func (s *Storage) removeKey(key string) {
+	delete(s.keysLinksUserID, key)
+	delete(s.revisions, key)
+	delete(s.clicks, key)
+}
+
+// ImportBatch stores a large chunk of shortened URLs; in memory it is the same as AddInBatch.
+func (s *Storage) ImportBatch(ctx context.Context, br []util.BatchResponse, baseURL string) error {
+	return s.AddInBatch(ctx, br, baseURL)
+}
+
+// GetAllLinksByUserID fetches the short URLs associated with a user ID that match opts and returns
+// one page of them, along with the cursor of the next page or an empty string on the last page.
+func (s *Storage) GetAllLinksByUserID(_ context.Context, userID, baseURL string, opts util.ListOptions) ([]util.AllURLSResponse, string, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
 
+	search := strings.ToLower(opts.Search)
+	desc := opts.Descending()
+
+	var keys []string
 	for key, value := range s.keysLinksUserID {
-		if value.UserID == userID {
-			allUrls = append(allUrls, util.AllURLSResponse{ShortURL: baseURL + "/" + key, OriginalURL: value.Link})
+		if value.UserID != userID {
+			continue
+		}
+		if opts.Deleted != nil && value.IsDeleted != *opts.Deleted {
+			continue
+		}
+		if search != "" && !strings.Contains(strings.ToLower(value.Link), search) {
+			continue
+		}
+		if opts.Cursor != nil && !opts.Cursor.After(value.CreatedAt, key, desc) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := s.keysLinksUserID[keys[i]], s.keysLinksUserID[keys[j]]
+		cursor := util.Cursor{CreatedAt: a.CreatedAt, Key: keys[i]}
+		return cursor.After(b.CreatedAt, keys[j], desc)
+	})
+
+	var next string
+	if opts.Limit > 0 && len(keys) > opts.Limit {
+		keys = keys[:opts.Limit]
+		last := keys[len(keys)-1]
+		next = util.Cursor{CreatedAt: s.keysLinksUserID[last].CreatedAt, Key: last}.Encode()
+	}
+
+	allUrls := []util.AllURLSResponse{}
+	for _, key := range keys {
+		v := s.keysLinksUserID[key]
+		allUrls = append(allUrls, util.AllURLSResponse{
+			ShortURL:      baseURL + "/" + key,
+			OriginalURL:   v.Link,
+			CreatedAt:     v.CreatedAt,
+			IsDeleted:     v.IsDeleted,
+			ExpiresAt:     v.ExpiresAt,
+			Clicks:        int64(len(s.clicks[key])),
+			CorrelationID: v.CorrelationID,
+		})
+	}
+
+	return allUrls, next, nil
+}
+
+// AddInBatch adds multiple shortened URLs at once to the storage and sets the status of every item.
+// Items already marked as invalid are skipped, and an original URL that is already shortened
+// gets the existing short URL instead of a new one.
+func (s *Storage) AddInBatch(_ context.Context, br []util.BatchResponse, baseURL string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	now := time.Now().UTC()
+	created := make(map[string]util.MapValue)
+	for i := range br {
+		v := &br[i]
+		if v.Status == util.BatchInvalid {
+			continue
 		}
+
+		key := v.ShortURL[len(baseURL)+1:]
+		if s.keyTaken(key) {
+			v.Reject(storage.ErrKeyTaken.Error())
+			continue
+		}
+
+		if existing, ok := s.findConflict(key, v.OriginalURL, util.DedupScope(s.dedupMode, v.UserID, key)); ok {
+			v.Status = util.BatchExisting
+			v.ShortURL = baseURL + "/" + existing
+			v.ExpiresAt = s.keysLinksUserID[existing].ExpiresAt
+			continue
+		}
+
+		value := util.MapValue{
+			Link:          v.OriginalURL,
+			UserID:        v.UserID,
+			ExpiresAt:     v.ExpiresAt,
+			CreatedAt:     now,
+			CorrelationID: v.CorrelationID,
+		}
+		s.removeKey(key)
+		s.keysLinksUserID[key] = value
+		created[key] = value
+		v.Status = util.BatchCreated
+	}
+
+	if err := s.writeToFile(created); err != nil {
+		slog.Error("failed to write storage file", "error", err)
 	}
 
-	return allUrls, nil
+	return nil
 }
 
-// AddInBatch adds multiple shortened URLs at once to the storage.
-func (s *Storage) AddInBatch(ctx context.Context, br []util.BatchResponse, baseURL string) (string, error) {
-	for _, v := range br {
-		err := s.Add(ctx, v.ShortURL[len(baseURL)+1:], v.OriginalURL, v.UserID)
-		if err != nil {
-			return v.ShortURL, err
+// ExportLinksByUserID calls fn for every short URL of the user, oldest first. The links are
+// copied under the lock and fn is called on that snapshot, so a slow reader does not block writers.
+// It stops at the first error returned by fn.
+func (s *Storage) ExportLinksByUserID(_ context.Context, userID, baseURL string, fn func(util.AllURLSResponse) error) error {
+	s.mtx.RLock()
+	var keys []string
+	for key, v := range s.keysLinksUserID {
+		if v.UserID == userID {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := s.keysLinksUserID[keys[i]], s.keysLinksUserID[keys[j]]
+		cursor := util.Cursor{CreatedAt: a.CreatedAt, Key: keys[i]}
+		return cursor.After(b.CreatedAt, keys[j], false)
+	})
+
+	snapshot := make([]util.AllURLSResponse, 0, len(keys))
+	for _, key := range keys {
+		v := s.keysLinksUserID[key]
+		snapshot = append(snapshot, util.AllURLSResponse{
+			ShortURL:      baseURL + "/" + key,
+			OriginalURL:   v.Link,
+			CreatedAt:     v.CreatedAt,
+			IsDeleted:     v.IsDeleted,
+			ExpiresAt:     v.ExpiresAt,
+			Clicks:        int64(len(s.clicks[key])),
+			CorrelationID: v.CorrelationID,
+		})
+	}
+	s.mtx.RUnlock()
+
+	for _, u := range snapshot {
+		if err := fn(u); err != nil {
+			return err
 		}
 	}
 
-	return "", nil
+	return nil
 }
 
-// DeleteURLS marks specified URLs as deleted for a given user ID.
-func (s *Storage) DeleteURLS(_ context.Context, userID string, shortenURLS []string) error {
-	for _, shortenURL := range shortenURLS {
-		s.mtx.RLock()
-		defer s.mtx.RUnlock()
+// DeleteURLS marks specified URLs as deleted for a given user ID
+// and returns how many of them were not deleted before.
+func (s *Storage) DeleteURLS(_ context.Context, userID string, shortenURLS []string) (int64, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	now := time.Now()
+	changed := make(map[string]util.MapValue)
 
+	var deleted int64
+	for _, shortenURL := range shortenURLS {
 		v, ok := s.keysLinksUserID[shortenURL]
 
-		if ok && v.UserID == userID {
+		if ok && v.UserID == userID && !v.IsDeleted {
 			v.IsDeleted = true
+			v.DeletedAt = &now
 			s.keysLinksUserID[shortenURL] = v
+			changed[shortenURL] = v
+			deleted++
 		}
 	}
+
+	if err := s.writeToFile(changed); err != nil {
+		slog.Error("failed to write storage file", "error", err)
+	}
+
+	return deleted, nil
+}
+
+// RestoreURLS clears the deleted flag of the specified URLs of a given user ID
+// and returns how many of them were restored.
+func (s *Storage) RestoreURLS(_ context.Context, userID string, shortenURLS []string) (int64, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	changed := make(map[string]util.MapValue)
+
+	var restored int64
+	for _, shortenURL := range shortenURLS {
+		v, ok := s.keysLinksUserID[shortenURL]
+
+		if ok && v.UserID == userID && v.IsDeleted {
+			v.IsDeleted = false
+			v.DeletedAt = nil
+			s.keysLinksUserID[shortenURL] = v
+			changed[shortenURL] = v
+			restored++
+		}
+	}
+
+	if err := s.writeToFile(changed); err != nil {
+		slog.Error("failed to write storage file", "error", err)
+	}
+
+	return restored, nil
+}
+
+// PurgeDeleted removes every URL deleted before the given time, along with its clicks and revisions,
+// and returns how many were removed. If a fileName is set in the storage, the removal is also
+// written to the file.
+func (s *Storage) PurgeDeleted(_ context.Context, before time.Time) (int64, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var purged []string
+	for key, v := range s.keysLinksUserID {
+		if v.IsDeleted && v.DeletedAt != nil && v.DeletedAt.Before(before) {
+			purged = append(purged, key)
+		}
+	}
+
+	if err := s.writePurgedToFile(purged); err != nil {
+		return 0, err
+	}
+
+	for _, key := range purged {
+		s.removeKey(key)
+	}
+
+	return int64(len(purged)), nil
+}
+
+// DeleteExpired removes every URL whose expiry is not after now, along with its clicks and revisions,
+// and returns how many were removed.
+func (s *Storage) DeleteExpired(_ context.Context, now time.Time) (int64, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var deleted int64
+	for key, v := range s.keysLinksUserID {
+		if v.IsExpired(now) {
+			s.removeKey(key)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+// AddClicks records the given clicks of existing keys.
+func (s *Storage) AddClicks(_ context.Context, clicks []util.Click) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, c := range clicks {
+		// Like the foreign key in postgres, drop the clicks of keys removed since the redirect.
+		if _, ok := s.keysLinksUserID[c.Key]; ok {
+			s.clicks[c.Key] = append(s.clicks[c.Key], c)
+		}
+	}
+
+	return nil
+}
+
+// GetClickStats returns the click statistics of the given key.
+func (s *Storage) GetClickStats(_ context.Context, key string) (util.ClickStats, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return util.CalculateClickStats(s.clicks[key]), nil
+}
+
+// CountURLs returns the number of shortened URLs in the storage.
+func (s *Storage) CountURLs(_ context.Context) (int64, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return int64(len(s.keysLinksUserID)), nil
+}
+
+// CountUsers returns the number of distinct users that have shortened at least one URL.
+func (s *Storage) CountUsers(_ context.Context) (int64, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	users := make(map[string]struct{})
+	for _, v := range s.keysLinksUserID {
+		users[v.UserID] = struct{}{}
+	}
+
+	return int64(len(users)), nil
+}
+
+// SaveDeleteJob stores the state of a delete job, appending it to the journal file if there is one.
+func (s *Storage) SaveDeleteJob(_ context.Context, job util.DeleteJob) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.jobsFileName != "" {
+		if err := file.AppendDeleteJob(s.jobsFileName, job); err != nil {
+			return err
+		}
+	}
+
+	s.deleteJobs[job.ID] = job
+	return nil
+}
+
+// GetDeleteJob returns the delete job with the given ID.
+func (s *Storage) GetDeleteJob(_ context.Context, id string) (util.DeleteJob, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	job, ok := s.deleteJobs[id]
+	if !ok {
+		return job, fmt.Errorf("%w: delete job %s", storage.ErrNotFound, id)
+	}
+
+	return job, nil
+}
+
+// GetPendingDeleteJobs returns the delete jobs that have not reached a final status.
+func (s *Storage) GetPendingDeleteJobs(_ context.Context) ([]util.DeleteJob, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	var jobs []util.DeleteJob
+	for _, job := range s.deleteJobs {
+		if !job.IsFinished() {
+			jobs = append(jobs, job)
+		}
+	}
+
+	return jobs, nil
+}
+
+// PruneDeleteJobs removes the finished delete jobs last updated before the given time
+// and returns how many were removed.
+func (s *Storage) PruneDeleteJobs(_ context.Context, before time.Time) (int64, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var pruned int64
+	for id, job := range s.deleteJobs {
+		if job.IsFinished() && job.UpdatedAt.Before(before) {
+			delete(s.deleteJobs, id)
+			pruned++
+		}
+	}
+
+	if pruned > 0 && s.jobsFileName != "" {
+		if err := file.WriteDeleteJobs(s.jobsFileName, s.deleteJobs); err != nil {
+			return pruned, err
+		}
+	}
+
+	return pruned, nil
+}
+
+// saveAPIKey stores the state of an API key, appending it to the key file if there is one.
+// The caller must hold the write lock.
+func (s *Storage) saveAPIKey(key util.APIKey) error {
+	if s.keysFileName != "" {
+		if err := file.AppendAPIKey(s.keysFileName, key); err != nil {
+			return err
+		}
+	}
+
+	s.apiKeys[key.ID] = key
+	s.apiKeyHashes[key.Hash] = key.ID
+	return nil
+}
+
+// AddAPIKey stores a new API key.
+func (s *Storage) AddAPIKey(_ context.Context, key util.APIKey) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if _, ok := s.apiKeys[key.ID]; ok {
+		return fmt.Errorf("%w: api key %s", storage.ErrConflict, key.ID)
+	}
+	if _, ok := s.apiKeyHashes[key.Hash]; ok {
+		return fmt.Errorf("%w: api key hash", storage.ErrConflict)
+	}
+
+	return s.saveAPIKey(key)
+}
+
+// GetAPIKeys returns the API keys of the user, including the revoked ones, oldest first.
+func (s *Storage) GetAPIKeys(_ context.Context, userID string) ([]util.APIKey, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	keys := []util.APIKey{}
+	for _, key := range s.apiKeys {
+		if key.UserID == userID {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+
+	return keys, nil
+}
+
+// RevokeAPIKey revokes the API key with the given ID if it belongs to the user.
+// Revoking a key that is already revoked does nothing.
+func (s *Storage) RevokeAPIKey(_ context.Context, userID, id string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	key, ok := s.apiKeys[id]
+	if !ok || key.UserID != userID {
+		return fmt.Errorf("%w: api key %s", storage.ErrNotFound, id)
+	}
+
+	if key.RevokedAt != nil {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	key.RevokedAt = &now
+	return s.saveAPIKey(key)
+}
+
+// GetUserIDByAPIKey returns the user of the API key with the given hash, unless it was revoked.
+func (s *Storage) GetUserIDByAPIKey(_ context.Context, hash string) (string, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	key, ok := s.apiKeys[s.apiKeyHashes[hash]]
+	if !ok || key.RevokedAt != nil {
+		return "", fmt.Errorf("%w: api key", storage.ErrNotFound)
+	}
+
+	return key.UserID, nil
+}
+
+// AddAccount stores a new account. It fails with storage.ErrConflict if the username is taken.
+func (s *Storage) AddAccount(_ context.Context, account util.Account) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if _, ok := s.accounts[account.Username]; ok {
+		return fmt.Errorf("%w: username %s", storage.ErrConflict, account.Username)
+	}
+	if _, ok := s.accountUsers[account.UserID]; ok {
+		return fmt.Errorf("%w: user %s already has an account", storage.ErrConflict, account.UserID)
+	}
+
+	if s.accountsFileName != "" {
+		if err := file.AppendAccount(s.accountsFileName, account); err != nil {
+			return err
+		}
+	}
+
+	s.accounts[account.Username] = account
+	s.accountUsers[account.UserID] = account.Username
 	return nil
 }
+
+// GetAccount returns the account with the given username.
+func (s *Storage) GetAccount(_ context.Context, username string) (util.Account, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	account, ok := s.accounts[username]
+	if !ok {
+		return account, fmt.Errorf("%w: account %s", storage.ErrNotFound, username)
+	}
+
+	return account, nil
+}
+
+// ClaimLinks gives the links and API keys of fromUserID to toUserID and returns how many links
+// changed owner. The user ID of an account cannot be claimed, so nothing is moved from it. In the
+// per-user deduplication mode a link whose original URL toUserID has already shortened keeps
+// working but is left out of deduplication, like in the database.
+func (s *Storage) ClaimLinks(_ context.Context, fromUserID, toUserID string) (int64, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if fromUserID == toUserID {
+		return 0, nil
+	}
+	if _, ok := s.accountUsers[fromUserID]; ok {
+		return 0, nil
+	}
+
+	taken := make(map[string]bool)
+	if s.dedupMode == util.DedupPerUser {
+		for _, v := range s.keysLinksUserID {
+			if v.UserID == toUserID && !v.DedupExcluded {
+				taken[v.Link] = true
+			}
+		}
+	}
+
+	changed := make(map[string]util.MapValue)
+	for key, v := range s.keysLinksUserID {
+		if v.UserID == fromUserID {
+			v.UserID = toUserID
+			if taken[v.Link] {
+				v.DedupExcluded = true
+			}
+			changed[key] = v
+		}
+	}
+
+	if err := s.writeToFile(changed); err != nil {
+		return 0, err
+	}
+
+	for key, v := range changed {
+		s.keysLinksUserID[key] = v
+	}
+
+	for _, key := range s.apiKeys {
+		if key.UserID == fromUserID {
+			key.UserID = toUserID
+			if err := s.saveAPIKey(key); err != nil {
+				return int64(len(changed)), err
+			}
+		}
+	}
+
+	return int64(len(changed)), nil
+}
@@ -3,12 +3,19 @@ package postgres
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 
+	"github.com/trunov/go-shortener/internal/app/storage"
 	"github.com/trunov/go-shortener/internal/app/util"
 )
 
@@ -19,140 +26,720 @@ type Pinger interface {
 
 // dbStorage is a database storage implementation using a PostgreSQL connection pool.
 type dbStorage struct {
-	dbpool *pgxpool.Pool
+	dbpool    *pgxpool.Pool
+	dedupMode string
 }
 
 // NewDBStorage creates a new instance of dbStorage with a given connection pool.
-func NewDBStorage(conn *pgxpool.Pool) *dbStorage {
-	return &dbStorage{dbpool: conn}
+// dedupMode is one of the util.Dedup modes and decides which URLs conflict on insert.
+func NewDBStorage(conn *pgxpool.Pool, dedupMode string) *dbStorage {
+	return &dbStorage{dbpool: conn, dedupMode: dedupMode}
+}
+
+// shortURLUniqueConstraint is the constraint that keeps short keys unique.
+const shortURLUniqueConstraint = "short_url_unique"
+
+// wrapError wraps the errors of pgx in the matching storage errors.
+func wrapError(err error) error {
+	if errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("%w: %w", storage.ErrNotFound, err)
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+		if pgErr.ConstraintName == shortURLUniqueConstraint {
+			return fmt.Errorf("%w: %w", storage.ErrKeyTaken, err)
+		}
+		return fmt.Errorf("%w: %w", storage.ErrDuplicateURL, err)
+	}
+
+	return err
 }
 
 // Get retrieves the original URL and its deletion status associated with a given key from the database.
 func (s *dbStorage) Get(ctx context.Context, key string) (util.ShortenerGet, error) {
 	var shortener util.ShortenerGet
 
-	err := s.dbpool.QueryRow(ctx, "SELECT original_url, is_deleted from shortener WHERE short_url = $1", key).Scan(&shortener.OriginalURL, &shortener.IsDeleted)
+	err := s.dbpool.QueryRow(ctx, "SELECT original_url, user_id, is_deleted, expires_at from shortener WHERE short_url = $1", key).Scan(&shortener.OriginalURL, &shortener.UserID, &shortener.IsDeleted, &shortener.ExpiresAt)
 	if err != nil {
-		return shortener, err
+		return shortener, wrapError(err)
 	}
 
 	return shortener, nil
 }
 
-// GetShortenKey finds and returns the key for a given original URL in the database.
-func (s *dbStorage) GetShortenKey(ctx context.Context, originalURL string) (string, error) {
+// GetShortenKey finds and returns the key that a new URL of the user would conflict with
+// for a given original URL in the database.
+func (s *dbStorage) GetShortenKey(ctx context.Context, originalURL, userID string) (string, error) {
 	var v string
 
-	err := s.dbpool.QueryRow(ctx, "SELECT short_url from shortener WHERE original_url = $1", originalURL).Scan(&v)
+	err := s.dbpool.QueryRow(ctx, "SELECT short_url from shortener WHERE original_url = $1 AND dedup_scope = $2 AND (expires_at IS NULL OR expires_at > now())", originalURL, util.DedupScope(s.dedupMode, userID, "")).Scan(&v)
 	if err != nil {
-		return "", err
+		return "", wrapError(err)
 	}
 
 	return v, nil
 }
 
+// deleteExpiredConflicts removes the expired rows that new rows would collide with, either on one of
+// keys or on the original URL at the same index of originalURLs in the scope at the same index of
+// scopes. Expired links thus count as absent before DeleteExpired has swept them.
+func deleteExpiredConflicts(ctx context.Context, tx pgx.Tx, keys, originalURLs, scopes []string) error {
+	_, err := tx.Exec(ctx, `DELETE FROM shortener WHERE expires_at <= now()
+AND (short_url = ANY($1) OR (original_url, dedup_scope) IN (SELECT * FROM unnest($2::text[], $3::text[])))`,
+		keys, originalURLs, scopes)
+
+	return err
+}
+
 // Add inserts a new shortened URL entry into the database.
-func (s *dbStorage) Add(ctx context.Context, key, link, userID string) error {
-	_, err := s.dbpool.Exec(ctx, "INSERT INTO shortener (short_url, original_url, user_id) values ($1, $2,$3)", key, link, userID)
+func (s *dbStorage) Add(ctx context.Context, key, link, userID string, expiresAt *time.Time) error {
+	tx, err := s.dbpool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback(ctx)
 
+	scope := util.DedupScope(s.dedupMode, userID, key)
+	if err := deleteExpiredConflicts(ctx, tx, []string{key}, []string{link}, []string{scope}); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, "INSERT INTO shortener (short_url, original_url, user_id, expires_at, dedup_scope) values ($1, $2, $3, $4, $5)", key, link, userID, expiresAt, scope)
+	if err != nil {
+		return wrapError(err)
+	}
+
+	return tx.Commit(ctx)
+}
+
+// UpdateURL replaces the original URL of a key owned by the user and records the previous one
+// in url_revisions, in a single transaction.
+func (s *dbStorage) UpdateURL(ctx context.Context, userID, key, originalURL string) error {
+	tx, err := s.dbpool.Begin(ctx)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	defer tx.Rollback(ctx)
+
+	var previous, owner, scope string
+	var isDeleted bool
+	err = tx.QueryRow(ctx, "SELECT original_url, user_id, is_deleted, dedup_scope FROM shortener WHERE short_url = $1 FOR UPDATE", key).Scan(&previous, &owner, &isDeleted, &scope)
+	if err != nil {
+		return wrapError(err)
+	}
+
+	if owner != userID {
+		return storage.ErrForbidden
+	}
+
+	if isDeleted {
+		return storage.ErrGone
+	}
+
+	if err := deleteExpiredConflicts(ctx, tx, nil, []string{originalURL}, []string{scope}); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, "UPDATE shortener SET original_url = $1 WHERE short_url = $2", originalURL, key); err != nil {
+		return wrapError(err)
+	}
+
+	if _, err := tx.Exec(ctx, "INSERT INTO url_revisions (short_url, original_url) VALUES ($1, $2)", key, previous); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// GetRevisions returns the earlier original URLs of a key, oldest first.
+func (s *dbStorage) GetRevisions(ctx context.Context, key string) ([]util.Revision, error) {
+	revisions := []util.Revision{}
+
+	rows, err := s.dbpool.Query(ctx, "SELECT original_url, changed_at FROM url_revisions WHERE short_url = $1 ORDER BY changed_at, id", key)
+	if err != nil {
+		return revisions, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var r util.Revision
+		if err := rows.Scan(&r.OriginalURL, &r.ChangedAt); err != nil {
+			return revisions, err
+		}
+		revisions = append(revisions, r)
+	}
+
+	return revisions, rows.Err()
 }
 
-// GetAllLinksByUserID fetches all the short URLs associated with a user ID from the database and returns them.
-func (s *dbStorage) GetAllLinksByUserID(ctx context.Context, userID, baseURL string) ([]util.AllURLSResponse, error) {
+// ImportBatch stores a large chunk of shortened URLs with the same results as AddInBatch.
+// The chunk is copied into a temporary table with CopyFrom and inserted from there in a single statement.
+func (s *dbStorage) ImportBatch(ctx context.Context, br []util.BatchResponse, baseURL string) error {
+	tx, err := s.dbpool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `CREATE TEMPORARY TABLE import_shortener
+(
+    idx            INT,
+    short_url      TEXT,
+    original_url   TEXT,
+    user_id        TEXT,
+    expires_at     TIMESTAMPTZ,
+    correlation_id TEXT,
+    dedup_scope    TEXT
+) ON COMMIT DROP`)
+	if err != nil {
+		return err
+	}
+
+	var rows [][]interface{}
+	for i, v := range br {
+		if v.Status == util.BatchInvalid {
+			continue
+		}
+
+		key := v.ShortURL[len(baseURL)+1:]
+		rows = append(rows, []interface{}{i, key, v.OriginalURL, v.UserID, v.ExpiresAt, v.CorrelationID, util.DedupScope(s.dedupMode, v.UserID, key)})
+	}
+
+	columns := []string{"idx", "short_url", "original_url", "user_id", "expires_at", "correlation_id", "dedup_scope"}
+	if _, err := tx.CopyFrom(ctx, pgx.Identifier{"import_shortener"}, columns, pgx.CopyFromRows(rows)); err != nil {
+		return err
+	}
+
+	// Expired links count as absent, like in deleteExpiredConflicts.
+	_, err = tx.Exec(ctx, `DELETE FROM shortener s USING import_shortener i WHERE s.expires_at <= now()
+AND (s.short_url = i.short_url OR (s.original_url = i.original_url AND s.dedup_scope = i.dedup_scope))`)
+	if err != nil {
+		return err
+	}
+
+	// Rows are inserted in input order, so the first of several equal original URLs is the one created.
+	created, err := tx.Query(ctx, `INSERT INTO shortener (short_url, original_url, user_id, expires_at, correlation_id, dedup_scope)
+SELECT short_url, original_url, user_id, expires_at, correlation_id, dedup_scope FROM import_shortener ORDER BY idx
+ON CONFLICT DO NOTHING RETURNING short_url`)
+	if err != nil {
+		return err
+	}
+
+	createdKeys := make(map[string]bool)
+	for created.Next() {
+		var key string
+		if err := created.Scan(&key); err != nil {
+			created.Close()
+			return err
+		}
+		createdKeys[key] = true
+	}
+	created.Close()
+	if err := created.Err(); err != nil {
+		return err
+	}
+
+	existing, err := tx.Query(ctx, `SELECT i.idx, s.short_url, s.expires_at FROM import_shortener i
+JOIN shortener s ON s.original_url = i.original_url AND s.dedup_scope = i.dedup_scope
+WHERE s.short_url <> i.short_url`)
+	if err != nil {
+		return err
+	}
+
+	for existing.Next() {
+		var idx int
+		var key string
+		var expiresAt *time.Time
+		if err := existing.Scan(&idx, &key, &expiresAt); err != nil {
+			existing.Close()
+			return err
+		}
+
+		if !createdKeys[br[idx].ShortURL[len(baseURL)+1:]] {
+			br[idx].Status = util.BatchExisting
+			br[idx].ShortURL = baseURL + "/" + key
+			br[idx].ExpiresAt = expiresAt
+		}
+	}
+	existing.Close()
+	if err := existing.Err(); err != nil {
+		return err
+	}
+
+	for i := range br {
+		v := &br[i]
+		if v.Status != "" {
+			continue
+		}
+
+		if createdKeys[v.ShortURL[len(baseURL)+1:]] {
+			v.Status = util.BatchCreated
+		} else {
+			// The insert clashed on the short key rather than on the original URL.
+			v.Reject(storage.ErrKeyTaken.Error())
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// userURLColumns are the columns of the shortener table, aliased as s, read by scanUserURL.
+const userURLColumns = `s.short_url, s.original_url, s.created_at, s.is_deleted, s.expires_at, s.correlation_id,
+	(SELECT count(*) FROM clicks c WHERE c.short_url = s.short_url)`
+
+// exportFetchSize is the number of rows fetched at once from the cursor of ExportLinksByUserID.
+const exportFetchSize = 1000
+
+// scanUserURL scans a row of userURLColumns and returns its key along with the listing entry.
+func scanUserURL(row pgx.Row, baseURL string) (string, util.AllURLSResponse, error) {
+	var shortURL string
+	var u util.AllURLSResponse
+	if err := row.Scan(&shortURL, &u.OriginalURL, &u.CreatedAt, &u.IsDeleted, &u.ExpiresAt, &u.CorrelationID, &u.Clicks); err != nil {
+		return "", u, err
+	}
+
+	u.ShortURL = baseURL + "/" + shortURL
+	return shortURL, u, nil
+}
+
+// GetAllLinksByUserID fetches the short URLs associated with a user ID that match opts and returns
+// one page of them, along with the cursor of the next page or an empty string on the last page.
+func (s *dbStorage) GetAllLinksByUserID(ctx context.Context, userID, baseURL string, opts util.ListOptions) ([]util.AllURLSResponse, string, error) {
 	allUrls := []util.AllURLSResponse{}
 
-	rows, err := s.dbpool.Query(ctx, "SELECT short_url, original_url, user_id from shortener")
+	args := []interface{}{userID}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	query := "SELECT " + userURLColumns + " FROM shortener s WHERE s.user_id = $1"
+	if opts.Deleted != nil {
+		query += " AND s.is_deleted = " + arg(*opts.Deleted)
+	}
+	if opts.Search != "" {
+		query += " AND s.original_url ILIKE " + arg("%"+escapeLike(opts.Search)+"%")
+	}
+
+	order := "ASC"
+	cmp := ">"
+	if opts.Descending() {
+		order = "DESC"
+		cmp = "<"
+	}
+
+	if opts.Cursor != nil {
+		query += fmt.Sprintf(" AND (s.created_at, s.short_url) %s (%s, %s)", cmp, arg(opts.Cursor.CreatedAt), arg(opts.Cursor.Key))
+	}
 
+	query += fmt.Sprintf(" ORDER BY s.created_at %s, s.short_url %s", order, order)
+	if opts.Limit > 0 {
+		query += " LIMIT " + arg(opts.Limit+1)
+	}
+
+	rows, err := s.dbpool.Query(ctx, query, args...)
 	if err != nil {
-		return allUrls, err
+		return allUrls, "", err
 	}
 
 	defer rows.Close()
 
+	var last util.Cursor
+	var next string
 	for rows.Next() {
-		var shortURL, originalURL, dbUserID string
-		err = rows.Scan(&shortURL, &originalURL, &dbUserID)
-		if err != nil {
-			return allUrls, err
+		if opts.Limit > 0 && len(allUrls) == opts.Limit {
+			next = last.Encode()
+			break
 		}
 
-		if userID == dbUserID {
-			allUrls = append(allUrls, util.AllURLSResponse{ShortURL: baseURL + "/" + shortURL, OriginalURL: originalURL})
+		shortURL, u, err := scanUserURL(rows, baseURL)
+		if err != nil {
+			return allUrls, "", err
 		}
+
+		allUrls = append(allUrls, u)
+		last = util.Cursor{CreatedAt: u.CreatedAt, Key: shortURL}
 	}
 
-	err = rows.Err()
-	if err != nil {
-		return allUrls, err
+	if err := rows.Err(); err != nil {
+		return allUrls, "", err
 	}
 
-	return allUrls, nil
+	return allUrls, next, nil
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern so that s is matched literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
 }
 
-// AddInBatch adds multiple shortened URLs at once to the database using a transaction.
-func (s *dbStorage) AddInBatch(ctx context.Context, br []util.BatchResponse, baseURL string) (string, error) {
+// AddInBatch adds multiple shortened URLs at once to the database using a transaction and sets the
+// status of every item. Items already marked as invalid are skipped, and an original URL that is
+// already shortened gets the existing short URL instead of a new one.
+func (s *dbStorage) AddInBatch(ctx context.Context, br []util.BatchResponse, baseURL string) error {
 	tx, err := s.dbpool.Begin(ctx)
 	if err != nil {
-		return "", err
+		return err
 	}
 
 	defer tx.Rollback(ctx)
 
-	for _, v := range br {
-		if _, err := tx.Exec(ctx, "INSERT INTO shortener (short_url, original_url, user_id) values ($1, $2,$3)", v.ShortURL[len(baseURL)+1:], v.OriginalURL, v.UserID); err != nil {
-			return v.ShortURL, err
+	var pending []int
+	var keys, originalURLs, scopes []string
+	batch := &pgx.Batch{}
+	for i, v := range br {
+		if v.Status == util.BatchInvalid {
+			continue
 		}
+
+		key := v.ShortURL[len(baseURL)+1:]
+		scope := util.DedupScope(s.dedupMode, v.UserID, key)
+		batch.Queue("INSERT INTO shortener (short_url, original_url, user_id, expires_at, correlation_id, dedup_scope) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT DO NOTHING RETURNING short_url",
+			key, v.OriginalURL, v.UserID, v.ExpiresAt, v.CorrelationID, scope)
+		pending = append(pending, i)
+		keys = append(keys, key)
+		originalURLs = append(originalURLs, v.OriginalURL)
+		scopes = append(scopes, scope)
 	}
 
-	err = tx.Commit(ctx)
-	if err != nil {
-		return "", err
+	if err := deleteExpiredConflicts(ctx, tx, keys, originalURLs, scopes); err != nil {
+		return err
+	}
+
+	results := tx.SendBatch(ctx, batch)
+
+	var conflicts []int
+	for _, i := range pending {
+		var key string
+		err := results.QueryRow().Scan(&key)
+		switch {
+		case err == nil:
+			br[i].Status = util.BatchCreated
+		case errors.Is(err, pgx.ErrNoRows):
+			conflicts = append(conflicts, i)
+		default:
+			results.Close()
+			return err
+		}
+	}
+
+	if err := results.Close(); err != nil {
+		return err
+	}
+
+	for _, i := range conflicts {
+		v := &br[i]
+		key := v.ShortURL[len(baseURL)+1:]
+
+		var existing string
+		var expiresAt *time.Time
+		err := tx.QueryRow(ctx, "SELECT short_url, expires_at FROM shortener WHERE original_url = $1 AND dedup_scope = $2",
+			v.OriginalURL, util.DedupScope(s.dedupMode, v.UserID, key)).Scan(&existing, &expiresAt)
+		switch {
+		case err == nil:
+			v.Status = util.BatchExisting
+			v.ShortURL = baseURL + "/" + existing
+			v.ExpiresAt = expiresAt
+		case errors.Is(err, pgx.ErrNoRows):
+			// The insert clashed on the short key rather than on the original URL.
+			v.Reject(storage.ErrKeyTaken.Error())
+		default:
+			return err
+		}
 	}
 
-	return "", nil
+	return tx.Commit(ctx)
 }
 
-// DeleteURLS marks specified URLs as deleted for a given user ID in the database.
-func (s *dbStorage) DeleteURLS(ctx context.Context, userID string, shortenURLS []string) error {
-	tx, err := s.dbpool.Begin(ctx)
+// ExportLinksByUserID calls fn for every short URL of the user, oldest first. The rows are
+// read from a server-side cursor, exportFetchSize at a time, so the user's links are never
+// held in memory at once. It stops at the first error returned by fn.
+func (s *dbStorage) ExportLinksByUserID(ctx context.Context, userID, baseURL string, fn func(util.AllURLSResponse) error) error {
+	tx, err := s.dbpool.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
 	if err != nil {
 		return err
 	}
 
-	b := &pgx.Batch{}
+	defer tx.Rollback(ctx)
+
+	query := "DECLARE export_urls NO SCROLL CURSOR FOR SELECT " + userURLColumns + " FROM shortener s WHERE s.user_id = $1 ORDER BY s.created_at, s.short_url"
+	if _, err := tx.Exec(ctx, query, userID); err != nil {
+		return err
+	}
+
+	for {
+		n, err := s.fetchExport(ctx, tx, baseURL, fn)
+		if err != nil {
+			return err
+		}
+
+		if n < exportFetchSize {
+			break
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// fetchExport passes the next rows of the export cursor to fn and returns how many there were.
+func (s *dbStorage) fetchExport(ctx context.Context, tx pgx.Tx, baseURL string, fn func(util.AllURLSResponse) error) (int, error) {
+	rows, err := tx.Query(ctx, "FETCH "+strconv.Itoa(exportFetchSize)+" FROM export_urls")
+	if err != nil {
+		return 0, err
+	}
+
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		_, u, err := scanUserURL(rows, baseURL)
+		if err != nil {
+			return n, err
+		}
+
+		if err := fn(u); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, rows.Err()
+}
+
+// DeleteURLS marks specified URLs as deleted for a given user ID in the database
+// and returns how many of them were not deleted before.
+func (s *dbStorage) DeleteURLS(ctx context.Context, userID string, shortenURLS []string) (int64, error) {
+	tag, err := s.dbpool.Exec(ctx, `
+		UPDATE shortener
+		SET is_deleted = true, deleted_at = now()
+		WHERE user_id = $1
+		AND short_url = ANY($2)
+		AND NOT is_deleted`, userID, shortenURLS)
+	if err != nil {
+		return 0, err
+	}
+
+	slog.Debug("marked links as deleted", "user_id", userID, "keys", shortenURLS, "deleted", tag.RowsAffected())
+
+	return tag.RowsAffected(), nil
+}
 
-	for _, shortenURL := range shortenURLS {
-		sqlStatement := `
+// RestoreURLS clears the deleted flag of the specified URLs of a given user ID in the database
+// and returns how many of them were restored.
+func (s *dbStorage) RestoreURLS(ctx context.Context, userID string, shortenURLS []string) (int64, error) {
+	tag, err := s.dbpool.Exec(ctx, `
 		UPDATE shortener
-		SET is_deleted = $1
-		WHERE short_url = $2
-		AND user_id = $3;`
+		SET is_deleted = false, deleted_at = NULL
+		WHERE user_id = $1
+		AND short_url = ANY($2)
+		AND is_deleted`, userID, shortenURLS)
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// PurgeDeleted removes every URL deleted before the given time and returns how many were removed.
+// Their clicks and revisions are removed with them by the foreign keys.
+func (s *dbStorage) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	tag, err := s.dbpool.Exec(ctx, "DELETE FROM shortener WHERE is_deleted AND deleted_at < $1", before)
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
 
-		b.Queue(sqlStatement, true, shortenURL, userID)
+// DeleteExpired removes every URL whose expiry is not after now and returns how many were removed.
+// Their clicks and revisions are removed with them by the foreign keys.
+func (s *dbStorage) DeleteExpired(ctx context.Context, now time.Time) (int64, error) {
+	tag, err := s.dbpool.Exec(ctx, "DELETE FROM shortener WHERE expires_at IS NOT NULL AND expires_at <= $1", now)
+	if err != nil {
+		return 0, err
 	}
 
-	batchResults := tx.SendBatch(ctx, b)
+	return tag.RowsAffected(), nil
+}
 
-	var qerr error
-	var rows pgx.Rows
-	for qerr == nil {
-		rows, qerr = batchResults.Query()
-		rows.Close()
+// AddClicks records the given clicks. They are copied into a temporary table with the COPY protocol
+// and inserted from there, dropping the clicks of keys removed since the redirect, which would
+// otherwise fail the whole batch on the foreign key to shortener.
+func (s *dbStorage) AddClicks(ctx context.Context, clicks []util.Click) error {
+	tx, err := s.dbpool.Begin(ctx)
+	if err != nil {
+		return err
 	}
 
-	if err = tx.Commit(ctx); err != nil {
-		fmt.Println("error occurred in here")
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `CREATE TEMPORARY TABLE import_clicks
+(
+    short_url   TEXT,
+    clicked_at  TIMESTAMPTZ,
+    referrer    TEXT,
+    user_agent  TEXT,
+    ip          TEXT
+) ON COMMIT DROP`)
+	if err != nil {
 		return err
 	}
 
-	log.Printf("I did set status of is_deleted to true to followed keys: %s\n", shortenURLS)
+	rows := make([][]interface{}, 0, len(clicks))
+	for _, c := range clicks {
+		rows = append(rows, []interface{}{c.Key, c.ClickedAt, c.Referrer, c.UserAgent, c.IP})
+	}
 
-	return nil
+	_, err = tx.CopyFrom(
+		ctx,
+		pgx.Identifier{"import_clicks"},
+		[]string{"short_url", "clicked_at", "referrer", "user_agent", "ip"},
+		pgx.CopyFromRows(rows),
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `INSERT INTO clicks (short_url, clicked_at, referrer, user_agent, ip)
+SELECT i.short_url, i.clicked_at, i.referrer, i.user_agent, i.ip FROM import_clicks i
+WHERE EXISTS (SELECT 1 FROM shortener s WHERE s.short_url = i.short_url)`)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// GetClickStats returns the click statistics of the given key.
+func (s *dbStorage) GetClickStats(ctx context.Context, key string) (util.ClickStats, error) {
+	stats := util.ClickStats{Daily: []util.DailyClicks{}}
+
+	err := s.dbpool.QueryRow(ctx, `
+		SELECT count(*), count(DISTINCT (ip, user_agent))
+		FROM clicks
+		WHERE short_url = $1`, key).Scan(&stats.Total, &stats.UniqueVisitors)
+	if err != nil {
+		return stats, err
+	}
+
+	rows, err := s.dbpool.Query(ctx, `
+		SELECT to_char(clicked_at AT TIME ZONE 'UTC', 'YYYY-MM-DD') AS day, count(*)
+		FROM clicks
+		WHERE short_url = $1
+		GROUP BY day
+		ORDER BY day`, key)
+	if err != nil {
+		return stats, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var d util.DailyClicks
+		if err := rows.Scan(&d.Date, &d.Clicks); err != nil {
+			return stats, err
+		}
+		stats.Daily = append(stats.Daily, d)
+	}
+
+	return stats, rows.Err()
+}
+
+// CountURLs returns the number of shortened URLs in the database.
+func (s *dbStorage) CountURLs(ctx context.Context) (int64, error) {
+	var count int64
+
+	err := s.dbpool.QueryRow(ctx, "SELECT count(*) FROM shortener").Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// CountUsers returns the number of distinct users that have shortened at least one URL.
+func (s *dbStorage) CountUsers(ctx context.Context) (int64, error) {
+	var count int64
+
+	err := s.dbpool.QueryRow(ctx, "SELECT count(DISTINCT user_id) FROM shortener").Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// SaveDeleteJob inserts a delete job or updates its state.
+func (s *dbStorage) SaveDeleteJob(ctx context.Context, job util.DeleteJob) error {
+	_, err := s.dbpool.Exec(ctx, `
+		INSERT INTO delete_jobs (id, user_id, keys, status, deleted, error, attempts, next_run_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (id) DO UPDATE
+		SET status = EXCLUDED.status,
+			deleted = EXCLUDED.deleted,
+			error = EXCLUDED.error,
+			attempts = EXCLUDED.attempts,
+			next_run_at = EXCLUDED.next_run_at,
+			updated_at = EXCLUDED.updated_at`,
+		job.ID, job.UserID, job.Keys, job.Status, job.Deleted, job.Error, job.Attempts, job.NextRunAt, job.CreatedAt, job.UpdatedAt)
+
+	return err
+}
+
+const selectDeleteJobs = `SELECT id, user_id, keys, status, deleted, error, attempts, next_run_at, created_at, updated_at FROM delete_jobs`
+
+func scanDeleteJob(row pgx.Row) (util.DeleteJob, error) {
+	var job util.DeleteJob
+
+	err := row.Scan(&job.ID, &job.UserID, &job.Keys, &job.Status, &job.Deleted, &job.Error, &job.Attempts, &job.NextRunAt, &job.CreatedAt, &job.UpdatedAt)
+	return job, err
+}
+
+// GetDeleteJob returns the delete job with the given ID.
+func (s *dbStorage) GetDeleteJob(ctx context.Context, id string) (util.DeleteJob, error) {
+	job, err := scanDeleteJob(s.dbpool.QueryRow(ctx, selectDeleteJobs+" WHERE id = $1", id))
+	if err != nil {
+		return job, wrapError(err)
+	}
+
+	return job, nil
+}
+
+// GetPendingDeleteJobs returns the delete jobs that have not reached a final status.
+func (s *dbStorage) GetPendingDeleteJobs(ctx context.Context) ([]util.DeleteJob, error) {
+	rows, err := s.dbpool.Query(ctx, selectDeleteJobs+" WHERE status IN ($1, $2) ORDER BY created_at", util.JobQueued, util.JobRunning)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var jobs []util.DeleteJob
+	for rows.Next() {
+		job, err := scanDeleteJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
+
+// PruneDeleteJobs removes the finished delete jobs last updated before the given time
+// and returns how many were removed.
+func (s *dbStorage) PruneDeleteJobs(ctx context.Context, before time.Time) (int64, error) {
+	tag, err := s.dbpool.Exec(ctx, "DELETE FROM delete_jobs WHERE status IN ($1, $2) AND updated_at < $3", util.JobDone, util.JobFailed, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
 }
 
 // Ping checks the database connection status.
@@ -164,3 +751,206 @@ func (s *dbStorage) Ping(ctx context.Context) error {
 	}
 	return nil
 }
+
+// AddAPIKey stores a new API key.
+func (s *dbStorage) AddAPIKey(ctx context.Context, key util.APIKey) error {
+	_, err := s.dbpool.Exec(ctx, "INSERT INTO api_keys (id, user_id, name, prefix, key_hash, created_at) VALUES ($1, $2, $3, $4, $5, $6)",
+		key.ID, key.UserID, key.Name, key.Prefix, key.Hash, key.CreatedAt)
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+		return fmt.Errorf("%w: %w", storage.ErrConflict, err)
+	}
+
+	return err
+}
+
+// GetAPIKeys returns the API keys of the user, including the revoked ones, oldest first.
+func (s *dbStorage) GetAPIKeys(ctx context.Context, userID string) ([]util.APIKey, error) {
+	keys := []util.APIKey{}
+
+	rows, err := s.dbpool.Query(ctx, "SELECT id, name, prefix, created_at, revoked_at FROM api_keys WHERE user_id = $1 ORDER BY created_at, id", userID)
+	if err != nil {
+		return keys, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		key := util.APIKey{UserID: userID}
+		if err := rows.Scan(&key.ID, &key.Name, &key.Prefix, &key.CreatedAt, &key.RevokedAt); err != nil {
+			return keys, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey revokes the API key with the given ID if it belongs to the user.
+// Revoking a key that is already revoked does nothing.
+func (s *dbStorage) RevokeAPIKey(ctx context.Context, userID, id string) error {
+	tag, err := s.dbpool.Exec(ctx, "UPDATE api_keys SET revoked_at = COALESCE(revoked_at, now()) WHERE id = $1 AND user_id = $2", id, userID)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: api key %s", storage.ErrNotFound, id)
+	}
+
+	return nil
+}
+
+// GetUserIDByAPIKey returns the user of the API key with the given hash, unless it was revoked.
+func (s *dbStorage) GetUserIDByAPIKey(ctx context.Context, hash string) (string, error) {
+	var userID string
+
+	err := s.dbpool.QueryRow(ctx, "SELECT user_id FROM api_keys WHERE key_hash = $1 AND revoked_at IS NULL", hash).Scan(&userID)
+	if err != nil {
+		return "", wrapError(err)
+	}
+
+	return userID, nil
+}
+
+// AddAccount stores a new account. It fails with storage.ErrConflict if the username is taken.
+func (s *dbStorage) AddAccount(ctx context.Context, account util.Account) error {
+	_, err := s.dbpool.Exec(ctx, "INSERT INTO accounts (username, user_id, password_hash, created_at) VALUES ($1, $2, $3, $4)",
+		account.Username, account.UserID, account.PasswordHash, account.CreatedAt)
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+		return fmt.Errorf("%w: %w", storage.ErrConflict, err)
+	}
+
+	return err
+}
+
+// GetAccount returns the account with the given username.
+func (s *dbStorage) GetAccount(ctx context.Context, username string) (util.Account, error) {
+	account := util.Account{Username: username}
+
+	err := s.dbpool.QueryRow(ctx, "SELECT user_id, password_hash, created_at FROM accounts WHERE username = $1", username).
+		Scan(&account.UserID, &account.PasswordHash, &account.CreatedAt)
+	if err != nil {
+		return account, wrapError(err)
+	}
+
+	return account, nil
+}
+
+// dedupScopeSQL returns the SQL expression of the deduplication scope that util.DedupScope gives
+// a row of shortener in mode. Rows left out of deduplication are only in the scope of their key.
+func dedupScopeSQL(mode string) string {
+	var scope string
+	switch mode {
+	case util.DedupPerUser:
+		scope = "'user:' || COALESCE(user_id, '')"
+	case util.DedupNone:
+		scope = "'key:' || short_url"
+	default:
+		scope = "''"
+	}
+
+	return "CASE WHEN dedup_excluded THEN 'key:' || short_url ELSE " + scope + " END"
+}
+
+// RescopeDedup moves every link into the deduplication scope of the current mode, so that links
+// created before the dedup_scope column existed, or under another mode, deduplicate like new ones
+// and like in the memory storage. When several links end up with the same original URL in one
+// scope, the oldest one stays in it and the others are left out of deduplication. It returns how
+// many links were moved. All replicas must run with the same mode.
+func (s *dbStorage) RescopeDedup(ctx context.Context) (int64, error) {
+	tx, err := s.dbpool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "LOCK TABLE shortener IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		return 0, err
+	}
+
+	scope := dedupScopeSQL(s.dedupMode)
+
+	// The links to move first go to the scope of their own key, which no other link can hold,
+	// so that no link takes a scope before the link that holds it has left.
+	tag, err := tx.Exec(ctx, "UPDATE shortener SET dedup_scope = 'key:' || short_url WHERE dedup_scope <> "+scope)
+	if err != nil {
+		return 0, err
+	}
+	if tag.RowsAffected() == 0 {
+		return 0, tx.Commit(ctx)
+	}
+
+	_, err = tx.Exec(ctx, `WITH ranked AS (
+    SELECT short_url, `+scope+` AS scope,
+           row_number() OVER (PARTITION BY original_url, `+scope+` ORDER BY dedup_scope = `+scope+` DESC, created_at, short_url) AS n
+    FROM shortener
+)
+UPDATE shortener s
+SET dedup_scope    = CASE WHEN r.n = 1 THEN r.scope ELSE s.dedup_scope END,
+    dedup_excluded = s.dedup_excluded OR r.n > 1
+FROM ranked r
+WHERE s.short_url = r.short_url AND s.dedup_scope <> r.scope`)
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), tx.Commit(ctx)
+}
+
+// ClaimLinks gives the links and API keys of fromUserID to toUserID in a single transaction and
+// returns how many links changed owner. The user ID of an account cannot be claimed, so nothing
+// is moved from it. In the per-user deduplication mode a link whose original URL toUserID has
+// already shortened keeps working but is left out of deduplication.
+func (s *dbStorage) ClaimLinks(ctx context.Context, fromUserID, toUserID string) (int64, error) {
+	if fromUserID == toUserID {
+		return 0, nil
+	}
+
+	tx, err := s.dbpool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback(ctx)
+
+	var hasAccount bool
+	err = tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM accounts WHERE user_id = $1)", fromUserID).Scan(&hasAccount)
+	if err != nil {
+		return 0, err
+	}
+	if hasAccount {
+		return 0, nil
+	}
+
+	tag, err := tx.Exec(ctx, `WITH claimed AS (
+    SELECT s.short_url,
+           s.dedup_scope = $3 AND EXISTS (SELECT 1 FROM shortener t WHERE t.original_url = s.original_url AND t.dedup_scope = $4) AS duplicate
+    FROM shortener s
+    WHERE s.user_id = $1
+)
+UPDATE shortener s
+SET user_id        = $2,
+    dedup_scope    = CASE
+        WHEN c.duplicate THEN 'key:' || s.short_url
+        WHEN s.dedup_scope = $3 THEN $4
+        ELSE s.dedup_scope
+    END,
+    dedup_excluded = s.dedup_excluded OR c.duplicate
+FROM claimed c
+WHERE s.short_url = c.short_url`,
+		fromUserID, toUserID, util.DedupScope(util.DedupPerUser, fromUserID, ""), util.DedupScope(util.DedupPerUser, toUserID, ""))
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(ctx, "UPDATE api_keys SET user_id = $2 WHERE user_id = $1", fromUserID, toUserID); err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), tx.Commit(ctx)
+}
@@ -0,0 +1,149 @@
+package storage_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/trunov/go-shortener/internal/app/file"
+	"github.com/trunov/go-shortener/internal/app/storage"
+	"github.com/trunov/go-shortener/internal/app/storage/memory"
+	"github.com/trunov/go-shortener/internal/app/storage/postgres"
+	"github.com/trunov/go-shortener/internal/app/util"
+	"github.com/trunov/go-shortener/migrate"
+)
+
+// claimStorage is the part of the storages that claiming links goes through.
+type claimStorage interface {
+	Get(ctx context.Context, key string) (util.ShortenerGet, error)
+	Add(ctx context.Context, key, link, userID string, expiresAt *time.Time) error
+	GetShortenKey(ctx context.Context, originalURL, userID string) (string, error)
+	UpdateURL(ctx context.Context, userID, key, originalURL string) error
+	ClaimLinks(ctx context.Context, fromUserID, toUserID string) (int64, error)
+}
+
+// openFunc opens the data of a storage in a deduplication mode, as a restart with that mode would.
+type openFunc func(t *testing.T, mode string) claimStorage
+
+// storages returns the storages to run through the same cases. Each storage starts empty. The
+// database storage is only included when TEST_DATABASE_DSN is set; its data is shared between
+// runs, so the cases use keys, users and URLs unique to the run.
+func storages(t *testing.T) map[string]openFunc {
+	t.Helper()
+
+	fileName := filepath.Join(t.TempDir(), "storage.json")
+	stores := map[string]openFunc{
+		"memory": func(t *testing.T, mode string) claimStorage {
+			keysAndLinks := map[string]util.MapValue{}
+			reader, err := file.SeedMapWithKeysAndLinks(fileName, keysAndLinks)
+			require.NoError(t, err)
+			require.NoError(t, reader.Close())
+
+			return memory.NewStorage(keysAndLinks, fileName, mode)
+		},
+	}
+
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Log("TEST_DATABASE_DSN is not set, skipping the database storage")
+		return stores
+	}
+
+	require.NoError(t, migrate.Migrate(dsn, migrate.Migrations))
+	dbpool, err := pgxpool.Connect(context.Background(), dsn)
+	require.NoError(t, err)
+	t.Cleanup(dbpool.Close)
+
+	stores["postgres"] = func(t *testing.T, mode string) claimStorage {
+		s := postgres.NewDBStorage(dbpool, mode)
+		_, err := s.RescopeDedup(context.Background())
+		require.NoError(t, err)
+		return s
+	}
+	return stores
+}
+
+func Test_ClaimLinksRescopesDuplicates(t *testing.T) {
+	ctx := context.Background()
+
+	for name, open := range storages(t) {
+		t.Run(name, func(t *testing.T) {
+			s := open(t, util.DedupPerUser)
+
+			run := util.GenerateRandomString()
+			anon, account := "anon-"+run, "account-"+run
+			shared, own := "https://example.com/shared/"+run, "https://example.com/own/"+run
+			anonShared, anonOwn, accountShared := run[:4]+"as", run[:4]+"ao", run[:4]+"cs"
+
+			require.NoError(t, s.Add(ctx, anonShared, shared, anon, nil))
+			require.NoError(t, s.Add(ctx, anonOwn, own, anon, nil))
+			require.NoError(t, s.Add(ctx, accountShared, shared, account, nil))
+
+			claimed, err := s.ClaimLinks(ctx, anon, account)
+			require.NoError(t, err)
+			assert.Equal(t, int64(2), claimed)
+
+			for _, key := range []string{anonShared, anonOwn} {
+				v, err := s.Get(ctx, key)
+				require.NoError(t, err)
+				assert.Equal(t, account, v.UserID, "%s changed owner", key)
+			}
+
+			key, err := s.GetShortenKey(ctx, shared, account)
+			require.NoError(t, err)
+			assert.Equal(t, accountShared, key, "the duplicate is left out of deduplication")
+
+			key, err = s.GetShortenKey(ctx, own, account)
+			require.NoError(t, err)
+			assert.Equal(t, anonOwn, key, "links without a duplicate join the scope of the account")
+
+			err = s.Add(ctx, run[:4]+"nw", own, account, nil)
+			assert.ErrorIs(t, err, storage.ErrDuplicateURL)
+
+			assert.NoError(t, s.UpdateURL(ctx, account, anonShared, own), "the duplicate does not conflict when updated")
+		})
+	}
+}
+
+func Test_DedupModeChange(t *testing.T) {
+	ctx := context.Background()
+
+	for name, open := range storages(t) {
+		t.Run(name, func(t *testing.T) {
+			run := util.GenerateRandomString()
+			user1, user2 := "user1-"+run, "user2-"+run
+			link := "https://example.com/mode/" + run
+			first, second, third := run[:4]+"m1", run[:4]+"m2", run[:4]+"m3"
+
+			// Links created before the dedup_scope column existed are in the global scope too.
+			s := open(t, util.DedupGlobal)
+			require.NoError(t, s.Add(ctx, first, link, user1, nil))
+			assert.ErrorIs(t, s.Add(ctx, second, link, user2, nil), storage.ErrDuplicateURL)
+
+			s = open(t, util.DedupPerUser)
+			require.NoError(t, s.Add(ctx, second, link, user2, nil), "links of other users no longer conflict")
+			assert.ErrorIs(t, s.Add(ctx, third, link, user1, nil), storage.ErrDuplicateURL, "links of the same user still conflict")
+
+			key, err := s.GetShortenKey(ctx, link, user1)
+			require.NoError(t, err)
+			assert.Equal(t, first, key)
+			key, err = s.GetShortenKey(ctx, link, user2)
+			require.NoError(t, err)
+			assert.Equal(t, second, key)
+
+			assert.NoError(t, s.UpdateURL(ctx, user2, second, link+"/updated"))
+			assert.NoError(t, s.UpdateURL(ctx, user2, second, link), "an update checks the scope the link is in")
+
+			s = open(t, util.DedupGlobal)
+			key, err = s.GetShortenKey(ctx, link, user2)
+			require.NoError(t, err)
+			assert.Equal(t, first, key, "the oldest link is kept when scopes merge")
+		})
+	}
+}
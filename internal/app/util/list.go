@@ -0,0 +1,69 @@
+package util
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Sort orders of ListOptions.
+const (
+	SortCreatedAsc  = "created_at"
+	SortCreatedDesc = "-created_at"
+)
+
+// ListOptions narrows down and pages the URLs of a user.
+// A zero Limit returns every matching URL, a nil Deleted matches both deleted and
+// active URLs and Search matches a case-insensitive substring of the original URL.
+type ListOptions struct {
+	Limit   int
+	Cursor  *Cursor
+	Sort    string
+	Deleted *bool
+	Search  string
+}
+
+// Descending reports whether the URLs are listed from the newest to the oldest.
+func (o ListOptions) Descending() bool {
+	return o.Sort == SortCreatedDesc
+}
+
+// Cursor is the position of the last URL of a page, in the order of ListOptions.Sort.
+// Key breaks ties between URLs created at the same time.
+type Cursor struct {
+	CreatedAt time.Time `json:"t"`
+	Key       string    `json:"k"`
+}
+
+// After reports whether a URL created at createdAt with the given key comes after the
+// cursor, listing from the oldest to the newest unless desc is set.
+func (c Cursor) After(createdAt time.Time, key string, desc bool) bool {
+	if !createdAt.Equal(c.CreatedAt) {
+		return createdAt.After(c.CreatedAt) != desc
+	}
+
+	return key != c.Key && (key > c.Key) != desc
+}
+
+// Encode returns the opaque representation of the cursor handed out to clients.
+func (c Cursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeCursor parses a cursor produced by Cursor.Encode.
+func DecodeCursor(s string) (Cursor, error) {
+	var c Cursor
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, errors.New("invalid cursor")
+	}
+
+	if err := json.Unmarshal(b, &c); err != nil || c.Key == "" {
+		return c, errors.New("invalid cursor")
+	}
+
+	return c, nil
+}
@@ -2,41 +2,200 @@
 package util
 
 import (
+	crand "crypto/rand"
 	"encoding/base64"
-	"fmt"
 	"math/rand"
+	"net"
+	"net/http"
+	"sort"
 	"time"
 )
 
 // KeysLinksUserID is a mapping of short URLs to their corresponding MapValue.
 type KeysLinksUserID map[string]MapValue
 
+// Statuses of a single item of a batch.
+const (
+	// BatchCreated means a new short URL was created for the item.
+	BatchCreated = "created"
+	// BatchExisting means the original URL was already shortened and ShortURL points at the existing key.
+	BatchExisting = "existing"
+	// BatchInvalid means the item was rejected; Error says why.
+	BatchInvalid = "invalid"
+)
+
 // BatchResponse represents a batch response for URL shortening,
 // which includes a correlation ID, the generated short URL, and the original URL.
 type BatchResponse struct {
-	CorrelationID string `json:"correlation_id"`
-	ShortURL      string `json:"short_url"`
-	OriginalURL   string `json:"-"`
-	UserID        string `json:"-"`
+	CorrelationID string     `json:"correlation_id"`
+	ShortURL      string     `json:"short_url,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	Status        string     `json:"status"`
+	Error         string     `json:"error,omitempty"`
+	OriginalURL   string     `json:"-"`
+	UserID        string     `json:"-"`
+}
+
+// Reject marks the item as invalid for the given reason.
+func (b *BatchResponse) Reject(reason string) {
+	b.Status = BatchInvalid
+	b.Error = reason
+	b.ShortURL = ""
+	b.ExpiresAt = nil
 }
 
 // ShortenerGet represents the result of getting a shortened URL's information.
 type ShortenerGet struct {
 	OriginalURL string
+	UserID      string
 	IsDeleted   bool
+	ExpiresAt   *time.Time
+}
+
+// IsExpired reports whether the shortened URL has an expiry that is not after now.
+func (s ShortenerGet) IsExpired(now time.Time) bool {
+	return s.ExpiresAt != nil && !now.Before(*s.ExpiresAt)
 }
 
-// MapValue encapsulates the link, associated user, and deletion status for a shortened URL.
+// MapValue encapsulates the link, associated user, deletion status and expiry for a shortened URL.
+// A nil ExpiresAt means that the link never expires.
 type MapValue struct {
-	Link      string
-	UserID    string
-	IsDeleted bool
+	Link          string
+	UserID        string
+	IsDeleted     bool
+	DeletedAt     *time.Time
+	ExpiresAt     *time.Time
+	CreatedAt     time.Time
+	CorrelationID string
+	// DedupExcluded leaves the link out of deduplication, as if it was created with DedupNone.
+	// It is set on links that could not keep their scope when they changed owner.
+	DedupExcluded bool
+}
+
+// IsExpired reports whether the link has an expiry that is not after now.
+func (v MapValue) IsExpired(now time.Time) bool {
+	return v.ExpiresAt != nil && !now.Before(*v.ExpiresAt)
+}
+
+// Revision is an earlier destination of a key, replaced at ChangedAt.
+type Revision struct {
+	OriginalURL string    `json:"original_url"`
+	ChangedAt   time.Time `json:"changed_at"`
+}
+
+// Click represents a single redirect through a shortened URL.
+// IP is already truncated with TruncateIP so that no full client address is stored.
+type Click struct {
+	Key       string
+	ClickedAt time.Time
+	Referrer  string
+	UserAgent string
+	IP        string
+}
+
+// DailyClicks holds the number of clicks on a single day in UTC, formatted as YYYY-MM-DD.
+type DailyClicks struct {
+	Date   string `json:"date"`
+	Clicks int64  `json:"clicks"`
+}
+
+// ClickStats summarizes the clicks of a shortened URL.
+// Unique visitors are counted by distinct truncated IP and user agent.
+type ClickStats struct {
+	Total          int64         `json:"total"`
+	UniqueVisitors int64         `json:"unique_visitors"`
+	Daily          []DailyClicks `json:"daily"`
+}
+
+// InternalStats holds the totals reported by the internal stats endpoint.
+type InternalStats struct {
+	URLs  int64 `json:"urls"`
+	Users int64 `json:"users"`
+}
+
+// Delete job statuses.
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// DeleteJob describes a request to delete a list of the user's keys and its progress.
+// Deleted is the number of keys that were actually marked as deleted. A job that failed
+// but will be retried stays queued with the last error and the time of its next attempt.
+type DeleteJob struct {
+	ID        string     `json:"id"`
+	UserID    string     `json:"-"`
+	Keys      []string   `json:"-"`
+	Status    string     `json:"status"`
+	Deleted   int64      `json:"deleted"`
+	Error     string     `json:"error,omitempty"`
+	Attempts  int        `json:"attempts"`
+	NextRunAt *time.Time `json:"next_run_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// IsFinished reports whether the job has reached a final status.
+func (j DeleteJob) IsFinished() bool {
+	return j.Status == JobDone || j.Status == JobFailed
 }
 
-// AllURLSResponse represents a response containing the shortened and original URLs.
+// APIKey is a key that authenticates requests as UserID. Only the Hash of the key is stored;
+// Prefix keeps its first characters so that users can tell their keys apart.
+type APIKey struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"`
+	UserID    string     `json:"-"`
+	Hash      string     `json:"-"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Account is a named user that signs in with a password and owns the links of UserID.
+// Only the bcrypt PasswordHash of the password is stored.
+type Account struct {
+	Username     string    `json:"username"`
+	UserID       string    `json:"-"`
+	PasswordHash string    `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// AllURLSResponse represents a shortened URL of a user along with its metadata.
+// CorrelationID is only set for URLs created by a batch request.
 type AllURLSResponse struct {
-	ShortURL    string `json:"short_url"`
-	OriginalURL string `json:"original_url"`
+	ShortURL      string     `json:"short_url"`
+	OriginalURL   string     `json:"original_url"`
+	CreatedAt     time.Time  `json:"created_at"`
+	IsDeleted     bool       `json:"is_deleted"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	Clicks        int64      `json:"clicks"`
+	CorrelationID string     `json:"correlation_id,omitempty"`
+}
+
+// Deduplication modes decide which shortened URLs may not share an original URL.
+const (
+	// DedupGlobal makes an original URL unique across all users.
+	DedupGlobal = "global"
+	// DedupPerUser makes an original URL unique per user.
+	DedupPerUser = "per-user"
+	// DedupNone allows any number of keys for the same original URL.
+	DedupNone = "none"
+)
+
+// DedupScope returns the scope in which the original URL of key, owned by userID, must be unique.
+// Two URLs conflict when they have the same original URL and the same scope.
+func DedupScope(mode, userID, key string) string {
+	switch mode {
+	case DedupPerUser:
+		return "user:" + userID
+	case DedupNone:
+		return "key:" + key
+	default:
+		return ""
+	}
 }
 
 // GenerateRandomString creates a random string of length 8 consisting of alphanumeric characters.
@@ -54,12 +213,12 @@ func GenerateRandomString() string {
 	return string(r)
 }
 
-// GenerateRandomUserID produces a random base64 encoded userID.
+// GenerateRandomUserID produces a random base64 encoded userID. User IDs own links, API keys and
+// accounts, so they come from crypto/rand and cannot be guessed.
 func GenerateRandomUserID() (string, error) {
 	b := make([]byte, 16)
-	_, err := rand.Read(b)
+	_, err := crand.Read(b)
 	if err != nil {
-		fmt.Printf("error: %v\n", err)
 		return "", err
 	}
 
@@ -90,25 +249,53 @@ func FindAllURLSByUserID(urlsMap map[string]MapValue, userID, baseURL string) []
 	return allUrls
 }
 
-// GenerateChannel splits the provided slice of shortened URLs into chunks
-// and sends them to a channel in chunkSize increments
-func GenerateChannel(shortenURLS []string) chan []string {
-	ch := make(chan []string)
-	const chunkSize = 2
+// ClientIP returns the address of the client that sent r, which is the remote address of the
+// connection. Headers set by the client are not trusted; middleware.RealIP replaces the remote
+// address with the X-Real-IP header of requests that come from a trusted proxy.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
 
-	go func() {
-		defer close(ch)
+	return host
+}
+
+// TruncateIP zeroes the host part of ip, keeping a /24 network for IPv4 and a /48 network for IPv6.
+// It returns an empty string if ip cannot be parsed.
+func TruncateIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
 
-		for i := 0; i < len(shortenURLS); i += chunkSize {
-			end := i + chunkSize
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
 
-			if end > len(shortenURLS) {
-				end = len(shortenURLS)
-			}
+	return parsed.Mask(net.CIDRMask(48, 128)).String()
+}
 
-			ch <- shortenURLS[i:end]
-		}
-	}()
+// CalculateClickStats builds ClickStats from the given clicks.
+func CalculateClickStats(clicks []Click) ClickStats {
+	stats := ClickStats{Daily: []DailyClicks{}}
+	visitors := make(map[string]struct{})
+	days := make(map[string]int64)
+
+	for _, c := range clicks {
+		stats.Total++
+		visitors[c.IP+"|"+c.UserAgent] = struct{}{}
+		days[c.ClickedAt.UTC().Format("2006-01-02")]++
+	}
+
+	stats.UniqueVisitors = int64(len(visitors))
+	for day, n := range days {
+		stats.Daily = append(stats.Daily, DailyClicks{Date: day, Clicks: n})
+	}
+
+	sort.Slice(stats.Daily, func(i, j int) bool {
+		return stats.Daily[i].Date < stats.Daily[j].Date
+	})
 
-	return ch
+	return stats
 }
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE shortener
+ADD CONSTRAINT short_url_unique UNIQUE (short_url);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE shortener
+DROP CONSTRAINT short_url_unique;
+-- +goose StatementEnd
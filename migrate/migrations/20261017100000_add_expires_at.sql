@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE shortener
+ADD expires_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS shortener_expires_at_idx ON shortener (expires_at) WHERE expires_at IS NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS shortener_expires_at_idx;
+
+ALTER TABLE shortener
+DROP COLUMN expires_at;
+-- +goose StatementEnd
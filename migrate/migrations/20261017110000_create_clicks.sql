@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS clicks
+(
+    id          BIGSERIAL PRIMARY KEY,
+    short_url   TEXT        NOT NULL,
+    clicked_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    referrer    TEXT        NOT NULL DEFAULT '',
+    user_agent  TEXT        NOT NULL DEFAULT '',
+    ip          TEXT        NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS clicks_short_url_clicked_at_idx ON clicks (short_url, clicked_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS clicks;
+-- +goose StatementEnd
@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS delete_jobs
+(
+    id          TEXT PRIMARY KEY,
+    user_id     TEXT        NOT NULL,
+    keys        TEXT[]      NOT NULL,
+    status      TEXT        NOT NULL,
+    deleted     BIGINT      NOT NULL DEFAULT 0,
+    error       TEXT        NOT NULL DEFAULT '',
+    attempts    INT         NOT NULL DEFAULT 0,
+    next_run_at TIMESTAMPTZ,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS delete_jobs_status_idx ON delete_jobs (status);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS delete_jobs;
+-- +goose StatementEnd
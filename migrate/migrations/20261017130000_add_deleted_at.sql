@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE shortener
+ADD deleted_at TIMESTAMPTZ;
+
+UPDATE shortener SET deleted_at = now() WHERE is_deleted;
+
+CREATE INDEX IF NOT EXISTS shortener_deleted_at_idx ON shortener (deleted_at) WHERE is_deleted;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS shortener_deleted_at_idx;
+
+ALTER TABLE shortener
+DROP COLUMN deleted_at;
+-- +goose StatementEnd
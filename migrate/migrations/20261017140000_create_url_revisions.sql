@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS url_revisions
+(
+    id           BIGSERIAL PRIMARY KEY,
+    short_url    TEXT        NOT NULL REFERENCES shortener (short_url) ON DELETE CASCADE,
+    original_url TEXT        NOT NULL,
+    changed_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS url_revisions_short_url_changed_at_idx ON url_revisions (short_url, changed_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS url_revisions;
+-- +goose StatementEnd
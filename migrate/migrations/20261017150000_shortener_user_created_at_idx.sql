@@ -0,0 +1,9 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE INDEX IF NOT EXISTS shortener_user_id_created_at_idx ON shortener (user_id, created_at, short_url);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS shortener_user_id_created_at_idx;
+-- +goose StatementEnd
@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE shortener
+ADD dedup_scope TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE shortener
+DROP CONSTRAINT original_url_unique;
+
+CREATE UNIQUE INDEX IF NOT EXISTS shortener_original_url_dedup_scope_idx ON shortener (original_url, dedup_scope);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS shortener_original_url_dedup_scope_idx;
+
+ALTER TABLE shortener
+ADD CONSTRAINT original_url_unique UNIQUE (original_url);
+
+ALTER TABLE shortener
+DROP COLUMN dedup_scope;
+-- +goose StatementEnd
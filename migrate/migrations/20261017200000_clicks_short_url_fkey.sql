@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+DELETE FROM clicks c WHERE NOT EXISTS (SELECT 1 FROM shortener s WHERE s.short_url = c.short_url);
+
+ALTER TABLE clicks
+ADD CONSTRAINT clicks_short_url_fkey FOREIGN KEY (short_url) REFERENCES shortener (short_url) ON DELETE CASCADE;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE clicks
+DROP CONSTRAINT IF EXISTS clicks_short_url_fkey;
+-- +goose StatementEnd